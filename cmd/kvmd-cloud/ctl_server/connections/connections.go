@@ -0,0 +1,77 @@
+package connections
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pikvm/kvmd-cloud/cmd/kvmd-cloud/ctl_server/peercred"
+	"github.com/pikvm/kvmd-cloud/internal/ctl"
+	"github.com/pikvm/kvmd-cloud/internal/proxy"
+	"github.com/rs/zerolog/log"
+)
+
+func SetupRoutes(r *gin.Engine, proxyPool *proxy.ProxyPool) {
+	r.GET("/connections", func(c *gin.Context) {
+		getConnections(c, proxyPool)
+	})
+	r.POST("/connections/kill", func(c *gin.Context) {
+		killConnections(c, proxyPool)
+	})
+}
+
+func getConnections(c *gin.Context, proxyPool *proxy.ProxyPool) {
+	tunnels := proxyPool.Tunnels()
+	response := ctl.ConnectionsResponse{
+		Connections: make([]ctl.TunnelInfo, 0, len(tunnels)),
+	}
+	for _, tunnel := range tunnels {
+		response.Connections = append(response.Connections, ctl.TunnelInfo{
+			Cid:           tunnel.Cid,
+			Target:        tunnel.Target,
+			ProxyEndpoint: tunnel.ProxyEndpoint,
+			StartedAt:     tunnel.StartedAt,
+			BytesIn:       tunnel.BytesIn(),
+			BytesOut:      tunnel.BytesOut(),
+			LastActivity:  tunnel.LastActivity(),
+		})
+	}
+	c.JSON(200, response)
+}
+
+func killConnections(c *gin.Context, proxyPool *proxy.ProxyPool) {
+	var request ctl.KillConnectionsRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, ctl.KillConnectionsResponse{Error: err.Error()})
+		return
+	}
+	if !request.All && request.Cid == "" {
+		c.JSON(400, ctl.KillConnectionsResponse{Error: "either cid or all must be specified"})
+		return
+	}
+
+	// The client's own claim can be forged, the peer credentials come from the kernel
+	requestedBy := "unknown peer"
+	if cred, ok := peercred.FromContext(c.Request.Context()); ok {
+		requestedBy = cred.String()
+	}
+	logger := log.Logger.With().
+		Str("component", "ctl").
+		Str("requested_by", requestedBy).
+		Str("claimed_requested_by", request.RequestedBy).
+		Logger()
+	reason := fmt.Sprintf("killed by %s via ctl", requestedBy)
+
+	if request.All {
+		killed := proxyPool.KillAllTunnels(reason)
+		logger.Warn().Strs("cids", killed).Msg("killing all connections on request")
+		c.JSON(200, ctl.KillConnectionsResponse{Ok: true, Killed: killed})
+		return
+	}
+
+	if !proxyPool.KillTunnel(request.Cid, reason) {
+		c.JSON(404, ctl.KillConnectionsResponse{Error: fmt.Sprintf("connection %s not found", request.Cid)})
+		return
+	}
+	logger.Warn().Str("cid", request.Cid).Msg("killing connection on request")
+	c.JSON(200, ctl.KillConnectionsResponse{Ok: true, Killed: []string{request.Cid}})
+}
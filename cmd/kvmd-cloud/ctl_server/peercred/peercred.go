@@ -0,0 +1,65 @@
+package peercred
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cred is the identity of the process on the other side of a unix socket, as reported by the kernel
+type Cred struct {
+	Uid uint32
+	Gid uint32
+	Pid int32
+}
+
+func (c Cred) String() string {
+	username := "unknown"
+	if u, err := user.LookupId(strconv.FormatUint(uint64(c.Uid), 10)); err == nil {
+		username = u.Username
+	}
+	return fmt.Sprintf("%s (uid=%d, pid=%d)", username, c.Uid, c.Pid)
+}
+
+type credCtxKey struct{}
+
+// ConnContext is an http.Server ConnContext hook storing the peer credentials of unix socket connections
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := getPeerCred(unixConn)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, credCtxKey{}, cred)
+}
+
+// FromContext returns the peer credentials of the connection the request came from
+func FromContext(ctx context.Context) (Cred, bool) {
+	cred, ok := ctx.Value(credCtxKey{}).(Cred)
+	return cred, ok
+}
+
+func getPeerCred(conn *net.UnixConn) (Cred, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return Cred{}, err
+	}
+	var ucred *unix.Ucred
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		ucred, sockErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return Cred{}, err
+	}
+	if sockErr != nil {
+		return Cred{}, sockErr
+	}
+	return Cred{Uid: ucred.Uid, Gid: ucred.Gid, Pid: ucred.Pid}, nil
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/pikvm/kvmd-cloud/internal/ctl"
+	"github.com/pikvm/kvmd-cloud/internal/proxy"
+	"github.com/rs/zerolog/log"
+)
+
+func SetupRoutes(r *gin.Engine, proxyPool *proxy.ProxyPool) {
+	r.GET("/services", getServices)
+	r.POST("/services", func(c *gin.Context) {
+		setService(c, proxyPool)
+	})
+}
+
+func getServices(c *gin.Context) {
+	services := config.ListServices()
+	response := ctl.ServicesResponse{
+		Services: make([]ctl.ServiceInfo, 0, len(services)),
+	}
+	for name, service := range services {
+		response.Services = append(response.Services, ctl.ServiceInfo{
+			Name:    name,
+			Target:  service.Target,
+			Enabled: service.Enabled,
+		})
+	}
+	slices.SortFunc(response.Services, func(a, b ctl.ServiceInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	c.JSON(200, response)
+}
+
+func setService(c *gin.Context, proxyPool *proxy.ProxyPool) {
+	var request ctl.SetServiceRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, ctl.SetServiceResponse{Error: err.Error()})
+		return
+	}
+	changed, err := config.SetServiceEnabled(request.Name, request.Enabled)
+	if err != nil {
+		c.JSON(404, ctl.SetServiceResponse{Error: err.Error()})
+		return
+	}
+	if changed {
+		log.Info().
+			Str("component", "ctl").
+			Str("service", request.Name).
+			Bool("enabled", request.Enabled).
+			Msg("service state changed, renewing proxy connections to announce it to the cloud")
+		proxyPool.ReannounceServices()
+	}
+	c.JSON(200, ctl.SetServiceResponse{Ok: true})
+}
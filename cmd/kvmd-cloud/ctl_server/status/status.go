@@ -3,14 +3,151 @@ package status
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/pikvm/kvmd-cloud/internal/ctl"
+	"github.com/pikvm/kvmd-cloud/internal/outbound"
+	"github.com/pikvm/kvmd-cloud/internal/proxy"
 )
 
-func SetupRoutes(r *gin.Engine) {
-	r.GET("/status", getStatus)
+func SetupRoutes(r *gin.Engine, proxyPool *proxy.ProxyPool) {
+	r.GET("/status", func(c *gin.Context) {
+		getStatus(c, proxyPool)
+	})
 }
 
-func getStatus(c *gin.Context) {
+func getStatus(c *gin.Context, proxyPool *proxy.ProxyPool) {
 	c.JSON(200, ctl.ApplicationStatusResponse{
 		PingerField: "Yahoo!!",
+		Bandwidth:   bandwidthStatus(proxyPool),
+		Admission:   admissionStatus(proxyPool),
+		Proxies:     proxiesStatus(proxyPool),
+		Draining:    drainingStatus(proxyPool),
+		Endpoints:   endpointsStatus(proxyPool),
+		PinFailures: pinFailuresStatus(),
 	})
 }
+
+func pinFailuresStatus() []ctl.PinFailureStatus {
+	failures := []ctl.PinFailureStatus{}
+	for _, failure := range outbound.PinFailures() {
+		failures = append(failures, ctl.PinFailureStatus{
+			Host:  failure.Host,
+			Error: failure.Error,
+			At:    failure.At,
+			Count: failure.Count,
+		})
+	}
+	return failures
+}
+
+func endpointsStatus(proxyPool *proxy.ProxyPool) map[string]ctl.EndpointHealthStatus {
+	endpoints := make(map[string]ctl.EndpointHealthStatus)
+	for _, health := range proxyPool.Health() {
+		status := health.Status()
+		endpoint := ctl.EndpointHealthStatus{
+			Score:               status.Score,
+			Circuit:             status.Circuit.String(),
+			ConsecutiveFailures: status.ConsecutiveFailures,
+			RecentDrops:         status.RecentDrops,
+			Rtt:                 status.Rtt,
+		}
+		if !status.OpenUntil.IsZero() {
+			endpoint.OpenUntil = &status.OpenUntil
+		}
+		endpoints[health.Endpoint] = endpoint
+	}
+	return endpoints
+}
+
+func drainingStatus(proxyPool *proxy.ProxyPool) []ctl.DrainStatus {
+	draining := []ctl.DrainStatus{}
+	for _, conn := range proxyPool.Draining() {
+		status := conn.Status()
+		drain := ctl.DrainStatus{
+			Endpoint:      conn.Addr,
+			ActiveTunnels: conn.Admission().Active(),
+			StartedAt:     status.DrainStartedAt,
+		}
+		if !status.DrainDeadline.IsZero() {
+			drain.Deadline = &status.DrainDeadline
+		}
+		draining = append(draining, drain)
+	}
+	return draining
+}
+
+func proxiesStatus(proxyPool *proxy.ProxyPool) map[string]ctl.ProxyConnectionStatus {
+	proxies := make(map[string]ctl.ProxyConnectionStatus)
+	for _, conn := range proxyPool.Connections() {
+		proxies[conn.Addr] = connectionStatus(conn.Status(), conn.Probes())
+	}
+	return proxies
+}
+
+func connectionStatus(status proxy.ConnectionStatus, probes proxy.ProbeStatus) ctl.ProxyConnectionStatus {
+	result := ctl.ProxyConnectionStatus{
+		State:            status.State.String(),
+		Attempts:         status.Attempts,
+		Rtt:              probes.Rtt,
+		RttJitter:        probes.Jitter,
+		ProbeMisses:      probes.Misses,
+		TotalProbeMisses: probes.TotalMisses,
+	}
+	if !probes.LastProbeAt.IsZero() {
+		result.LastProbeAt = &probes.LastProbeAt
+	}
+	if status.LastError != nil {
+		result.LastError = status.LastError.Error()
+	}
+	if !status.ConnectedSince.IsZero() {
+		result.ConnectedSince = &status.ConnectedSince
+	}
+	if !status.NextRetryAt.IsZero() {
+		result.NextRetryAt = &status.NextRetryAt
+	}
+	return result
+}
+
+func bandwidthStatus(proxyPool *proxy.ProxyPool) ctl.BandwidthStatus {
+	status := ctl.BandwidthStatus{
+		Global:  shaperStatus(proxyPool.Bandwidth()),
+		Proxies: make(map[string]ctl.BandwidthShaperStatus),
+	}
+	for _, conn := range proxyPool.Connections() {
+		status.Proxies[conn.Addr] = shaperStatus(conn.Bandwidth())
+	}
+	return status
+}
+
+func shaperStatus(shaper *proxy.BandwidthShaper) ctl.BandwidthShaperStatus {
+	return ctl.BandwidthShaperStatus{
+		Upload:   limiterStatus(shaper.Upload),
+		Download: limiterStatus(shaper.Download),
+	}
+}
+
+func limiterStatus(limiter *proxy.BandwidthLimiter) ctl.BandwidthLimiterStatus {
+	return ctl.BandwidthLimiterStatus{
+		Limit:          limiter.Limit(),
+		Throttling:     limiter.IsThrottling(),
+		ThrottledTotal: limiter.ThrottledTotal(),
+	}
+}
+
+func admissionStatus(proxyPool *proxy.ProxyPool) ctl.AdmissionStatus {
+	status := ctl.AdmissionStatus{
+		Global:  tunnelLimiterStatus(proxyPool.Admission()),
+		Proxies: make(map[string]ctl.TunnelLimiterStatus),
+	}
+	for _, conn := range proxyPool.Connections() {
+		status.Proxies[conn.Addr] = tunnelLimiterStatus(conn.Admission())
+	}
+	return status
+}
+
+func tunnelLimiterStatus(limiter *proxy.TunnelLimiter) ctl.TunnelLimiterStatus {
+	return ctl.TunnelLimiterStatus{
+		Active:              limiter.Active(),
+		MaxActive:           limiter.MaxActive(),
+		RejectedTooMany:     limiter.RejectedTooMany(),
+		RejectedRateLimited: limiter.RejectedRateLimited(),
+	}
+}
@@ -7,18 +7,24 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pikvm/kvmd-cloud/cmd/kvmd-cloud/ctl_server/connections"
+	"github.com/pikvm/kvmd-cloud/cmd/kvmd-cloud/ctl_server/peercred"
+	"github.com/pikvm/kvmd-cloud/cmd/kvmd-cloud/ctl_server/services"
 	"github.com/pikvm/kvmd-cloud/cmd/kvmd-cloud/ctl_server/status"
 	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/pikvm/kvmd-cloud/internal/proxy"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func setupRoutes(r *gin.Engine) {
-	status.SetupRoutes(r)
+func setupRoutes(r *gin.Engine, proxyPool *proxy.ProxyPool) {
+	status.SetupRoutes(r, proxyPool)
+	connections.SetupRoutes(r, proxyPool)
+	services.SetupRoutes(r, proxyPool)
 	// ...
 }
 
-func RunServer(ctx context.Context) error {
+func RunServer(ctx context.Context, proxyPool *proxy.ProxyPool) error {
 	logger := log.Logger
 
 	if zerolog.GlobalLevel() > zerolog.DebugLevel {
@@ -28,12 +34,14 @@ func RunServer(ctx context.Context) error {
 	}
 	r := gin.New()
 	r.Use(gin.Recovery())
-	setupRoutes(r)
+	setupRoutes(r, proxyPool)
 
 	srv := &http.Server{
-		Handler: r,
+		Handler:     r,
+		ConnContext: peercred.ConnContext,
 	}
-	unixListener, err := net.Listen("unix", config.Cfg.UnixCtlSocket)
+	unixCtlSocket := config.Get().UnixCtlSocket
+	unixListener, err := net.Listen("unix", unixCtlSocket)
 	if err != nil {
 		return err
 	}
@@ -41,7 +49,7 @@ func RunServer(ctx context.Context) error {
 	var serveStopError error
 	runErrorChan := make(chan error)
 	go func() {
-		logger.Info().Msg("Listening on unix socket " + config.Cfg.UnixCtlSocket)
+		logger.Info().Msg("Listening on unix socket " + unixCtlSocket)
 		serveStopError = srv.Serve(unixListener)
 		runErrorChan <- serveStopError
 		close(runErrorChan)
@@ -10,6 +10,7 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/pikvm/kvmd-cloud/cmd/kvmd-cloud/ctl_server"
+	"github.com/pikvm/kvmd-cloud/internal/audit"
 	"github.com/pikvm/kvmd-cloud/internal/config"
 	"github.com/pikvm/kvmd-cloud/internal/config/vars"
 	"github.com/pikvm/kvmd-cloud/internal/proxy"
@@ -32,16 +33,41 @@ func root(ctx context.Context, rootCmd *cli.Command) error {
 
 	logger.Info().Str("version", vars.VersionString).Msgf("Starting %s", vars.AppName)
 
+	// Reloads are checked by proxy.ValidateConfig as a whole
+	if err := proxy.ValidateProxyProtocol(config.Get()); err != nil {
+		return err
+	}
+
+	if err := audit.Setup(); err != nil {
+		logger.Err(err).Msg("Unable to open audit log, tunnels won't be audited")
+	}
+	defer audit.Close()
+
 	group, ctx := errgroup.WithContext(ctx)
 
+	// ctl server stays up while the pool drains its tunnels to report the progress
+	ctlCtx, cancelCtl := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelCtl()
+
 	proxyPool := proxy.NewProxyPool()
 	group.Go(func() error {
+		defer cancelCtl()
 		proxyPool.Serve(ctx)
 		return nil
 	})
 
 	group.Go(func() error {
-		err := ctl_server.RunServer(ctx)
+		proxy.RunTokenRefresh(ctx)
+		return nil
+	})
+
+	reloader := &reloader{cmd: rootCmd, proxyPool: proxyPool}
+	group.Go(func() error {
+		return reloader.run(ctx)
+	})
+
+	group.Go(func() error {
+		err := ctl_server.RunServer(ctlCtx, proxyPool)
 		if err != nil {
 			err = fmt.Errorf("unable to launch ctl server: %w", err)
 		}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pikvm/kvmd-cloud/internal/audit"
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/pikvm/kvmd-cloud/internal/proxy"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+)
+
+// Editors and ctl write config files in several steps, so events are collected for a while
+const configWatchDebounce = 500 * time.Millisecond
+
+type reloader struct {
+	cmd       *cli.Command
+	proxyPool *proxy.ProxyPool
+}
+
+// run reloads the config on SIGHUP and, if enabled, on changes of the config files
+func (r *reloader) run(ctx context.Context) error {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	var fsEvents <-chan fsnotify.Event
+	var fsErrors <-chan error
+	if config.Get().WatchConfig {
+		watcher, err := watchConfigFiles()
+		if err != nil {
+			log.Err(err).Msg("Unable to watch config files, only SIGHUP will reload the config")
+		} else {
+			defer watcher.Close()
+			fsEvents = watcher.Events
+			fsErrors = watcher.Errors
+		}
+	}
+
+	debounce := time.NewTimer(0)
+	<-debounce.C
+	for {
+		select {
+		case <-ctx.Done():
+			debounce.Stop()
+			return nil
+		case <-sighup:
+			log.Info().Msg("SIGHUP received, reloading config")
+			r.reload()
+		case event := <-fsEvents:
+			if isConfigFile(event.Name) {
+				debounce.Reset(configWatchDebounce)
+			}
+		case err := <-fsErrors:
+			log.Err(err).Msg("Config watcher error")
+		case <-debounce.C:
+			log.Info().Msg("Config files changed, reloading config")
+			r.reload()
+		}
+	}
+}
+
+func (r *reloader) reload() {
+	cfg, err := config.ReadConfig(r.cmd)
+	if err == nil {
+		err = proxy.ValidateConfig(cfg)
+	}
+	var old *config.Config
+	if err == nil {
+		old, err = config.ApplyConfig(cfg)
+	}
+	if err != nil {
+		log.Err(err).Msg("New config is invalid, keeping the current one")
+		return
+	}
+	logger := log.Logger
+	logger.Info().Msg("Config reloaded")
+
+	if !reflect.DeepEqual(old.Audit, cfg.Audit) {
+		if err := audit.Setup(); err != nil {
+			logger.Err(err).Msg("Unable to reopen audit log, tunnels won't be audited")
+		}
+	}
+
+	switch {
+	case old.AuthToken != cfg.AuthToken || old.NoSSL != cfg.NoSSL || !reflect.DeepEqual(old.SSL, cfg.SSL):
+		logger.Info().Msg("Proxy credentials changed, reconnecting")
+		r.proxyPool.Reconnect()
+	case !reflect.DeepEqual(old.OutboundProxy, cfg.OutboundProxy):
+		logger.Info().Msg("Outbound proxy changed, reconnecting")
+		r.proxyPool.Reconnect()
+	case old.Hive != cfg.Hive ||
+		old.Proxy.EndpointsMode != cfg.Proxy.EndpointsMode ||
+		!slices.Equal(old.Proxy.Endpoints, cfg.Proxy.Endpoints):
+		logger.Info().Msg("Proxy endpoints source changed, updating proxy endpoints")
+		r.proxyPool.UpdateEndpoints()
+	}
+
+	if !reflect.DeepEqual(old.Services, cfg.Services) {
+		logger.Info().Msg("Services changed, renewing proxy connections to announce them")
+		r.proxyPool.ReannounceServices()
+	}
+
+	// These are used only at startup
+	if old.UnixCtlSocket != cfg.UnixCtlSocket ||
+		old.WatchConfig != cfg.WatchConfig ||
+		old.Log.Trace != cfg.Log.Trace ||
+		old.Tunnel.Bandwidth != cfg.Tunnel.Bandwidth ||
+		old.Tunnel.MaxTunnels != cfg.Tunnel.MaxTunnels ||
+		old.Tunnel.MaxTunnelsPerProxy != cfg.Tunnel.MaxTunnelsPerProxy ||
+		old.Tunnel.NewTunnelsRate != cfg.Tunnel.NewTunnelsRate ||
+		old.Tunnel.NewTunnelsBurst != cfg.Tunnel.NewTunnelsBurst {
+		logger.Warn().Msg("Some of the changed options take effect only after restart")
+	}
+}
+
+// watchConfigFiles watches directories of the config files, because files are often replaced instead of being written
+func watchConfigFiles() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]struct{}{}
+	for _, configFile := range config.ConfigFiles {
+		dirs[filepath.Dir(filepath.Clean(configFile.Path))] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			log.Err(err).Str("dir", dir).Msg("Unable to watch config directory")
+		}
+	}
+	return watcher, nil
+}
+
+func isConfigFile(path string) bool {
+	path = filepath.Clean(path)
+	for _, configFile := range config.ConfigFiles {
+		if filepath.Clean(configFile.Path) == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package ctl_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v3"
+
+	"github.com/pikvm/kvmd-cloud/internal/ctl"
+)
+
+func BuildConnectionsCommand() *cli.Command {
+	return &cli.Command{
+		Name:   "connections",
+		Usage:  "List active cloud tunnels",
+		Action: RequestConnections,
+		Commands: []*cli.Command{
+			{
+				Name:      "kill",
+				Usage:     "Forcibly terminate an active cloud tunnel",
+				ArgsUsage: "<cid>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "Terminate all active tunnels",
+					},
+				},
+				Action: RequestKillConnections,
+			},
+		},
+	}
+}
+
+func RequestConnections(ctx context.Context, cmd *cli.Command) error {
+	var connections ctl.ConnectionsResponse
+	if err := DoUnixRequestJSON(ctx, "GET", "/connections", nil, &connections); err != nil {
+		return err
+	}
+
+	if len(connections.Connections) == 0 {
+		fmt.Println("No active connections")
+		return nil
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CID\tTARGET\tPROXY\tAGE\tIN\tOUT\tIDLE")
+	for _, conn := range connections.Connections {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			conn.Cid,
+			conn.Target,
+			conn.ProxyEndpoint,
+			now.Sub(conn.StartedAt).Truncate(time.Second),
+			conn.BytesIn,
+			conn.BytesOut,
+			now.Sub(conn.LastActivity).Truncate(time.Second),
+		)
+	}
+	return w.Flush()
+}
+
+func RequestKillConnections(ctx context.Context, cmd *cli.Command) error {
+	request := ctl.KillConnectionsRequest{
+		Cid:         cmd.Args().First(),
+		All:         cmd.Bool("all"),
+		RequestedBy: requestedBy(),
+	}
+	if request.All == (request.Cid != "") {
+		return errors.New("specify either a connection cid or --all")
+	}
+
+	var response ctl.KillConnectionsResponse
+	if err := DoUnixRequestJSON(ctx, "POST", "/connections/kill", request, &response); err != nil {
+		return err
+	}
+	if !response.Ok {
+		return errors.New(response.Error)
+	}
+	for _, cid := range response.Killed {
+		fmt.Printf("Killed %s\n", cid)
+	}
+	return nil
+}
+
+func requestedBy() string {
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	return fmt.Sprintf("%s (uid=%d, pid=%d)", username, os.Getuid(), os.Getpid())
+}
@@ -0,0 +1,139 @@
+package ctl_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/pikvm/kvmd-cloud/internal/ctl"
+)
+
+func BuildServicesCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "services",
+		Usage: "Manage local services published through the cloud",
+		Commands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List configured services",
+				Action: RequestServicesList,
+			},
+			{
+				Name:      "enable",
+				Usage:     "Enable a service",
+				ArgsUsage: "<name>",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return setServiceEnabled(ctx, cmd.Args().First(), true)
+				},
+			},
+			{
+				Name:      "disable",
+				Usage:     "Disable a service",
+				ArgsUsage: "<name>",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return setServiceEnabled(ctx, cmd.Args().First(), false)
+				},
+			},
+		},
+	}
+}
+
+func RequestServicesList(ctx context.Context, cmd *cli.Command) error {
+	var response ctl.ServicesResponse
+	if err := DoUnixRequestJSON(ctx, "GET", "/services", nil, &response); err != nil {
+		log.Logger.Warn().Err(err).Msg("kvmd-cloud is not reachable, showing services from the local config")
+		response = localServices()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tENABLED\tTARGET")
+	for _, service := range response.Services {
+		fmt.Fprintf(w, "%s\t%t\t%s\n", service.Name, service.Enabled, service.Target)
+	}
+	return w.Flush()
+}
+
+func localServices() ctl.ServicesResponse {
+	response := ctl.ServicesResponse{}
+	for name, service := range config.ListServices() {
+		response.Services = append(response.Services, ctl.ServiceInfo{
+			Name:    name,
+			Target:  service.Target,
+			Enabled: service.Enabled,
+		})
+	}
+	slices.SortFunc(response.Services, func(a, b ctl.ServiceInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return response
+}
+
+func setServiceEnabled(ctx context.Context, name string, enabled bool) error {
+	logger := log.Logger
+
+	if name == "" {
+		return errors.New("service name is required")
+	}
+	if _, ok := config.LookupService(name); !ok {
+		return fmt.Errorf("service %q is not configured", name)
+	}
+
+	if err := saveServiceEnabled(name, enabled); err != nil {
+		return fmt.Errorf("unable to save services configuration: %w", err)
+	}
+
+	var response ctl.SetServiceResponse
+	err := DoUnixRequestJSON(ctx, "POST", "/services", ctl.SetServiceRequest{Name: name, Enabled: enabled}, &response)
+	if err != nil {
+		logger.Warn().Err(err).Msg("kvmd-cloud is not reachable, the change will be applied on its next start")
+		return nil
+	}
+	if !response.Ok {
+		return errors.New(response.Error)
+	}
+	logger.Info().Msgf("Service %s is %s", name, map[bool]string{true: "enabled", false: "disabled"}[enabled])
+	return nil
+}
+
+// saveServiceEnabled persists the service state to the services config file keeping the rest of its content
+func saveServiceEnabled(name string, enabled bool) error {
+	content := map[string]any{}
+	if data, err := os.ReadFile(config.ServicesFilepath); err == nil {
+		if err := yaml.Unmarshal(data, &content); err != nil {
+			return err
+		}
+		if content == nil {
+			content = map[string]any{}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	services, _ := content["services"].(map[string]any)
+	if services == nil {
+		services = map[string]any{}
+	}
+	service, _ := services[name].(map[string]any)
+	if service == nil {
+		service = map[string]any{}
+	}
+	service["enabled"] = enabled
+	services[name] = service
+	content["services"] = services
+
+	out, err := yaml.Marshal(content)
+	if err != nil {
+		return err
+	}
+	// Written atomically, because kvmd-cloud may reload it at any moment
+	return config.WriteFileAtomic(config.ServicesFilepath, out, 0644)
+}
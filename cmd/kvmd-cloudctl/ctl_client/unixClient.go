@@ -12,7 +12,7 @@ import (
 )
 
 func newUnixClient() http.Client {
-	unixFilename := config.Cfg.UnixCtlSocket
+	unixFilename := config.Get().UnixCtlSocket
 	httpc := http.Client{
 		Transport: &http.Transport{
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -25,7 +25,7 @@ func newUnixClient() http.Client {
 
 func DoUnixRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Response, error) {
 	client := newUnixClient()
-	req, err := http.NewRequestWithContext(ctx, method, "http://unix"+config.Cfg.UnixCtlSocket+url, body)
+	req, err := http.NewRequestWithContext(ctx, method, "http://unix"+config.Get().UnixCtlSocket+url, body)
 	if err != nil {
 		return nil, err
 	}
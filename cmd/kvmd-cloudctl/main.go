@@ -41,6 +41,8 @@ func main() {
 func subCommands() []*cli.Command {
 	return []*cli.Command{
 		ctl_client.BuildStatusCommand(),
+		ctl_client.BuildConnectionsCommand(),
+		ctl_client.BuildServicesCommand(),
 		setup.BuildCommand(),
 	}
 }
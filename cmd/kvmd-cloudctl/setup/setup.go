@@ -12,18 +12,17 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"syscall"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v3"
 	"golang.org/x/term"
-	"gopkg.in/yaml.v3"
 
 	"github.com/pikvm/cloud-api/api_models"
 	"github.com/pikvm/cloud-api/domain_errors"
 	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/pikvm/kvmd-cloud/internal/outbound"
 )
 
 const (
@@ -100,8 +99,6 @@ func Setup(ctx context.Context, cmd *cli.Command) error {
 		return err
 	}
 
-	config.Cfg.AuthToken = token
-
 	logger.Info().Msg("Performing a cloud connection attempt...")
 	me, err := whoami(ctx, token)
 	if err != nil {
@@ -109,7 +106,7 @@ func Setup(ctx context.Context, cmd *cli.Command) error {
 	}
 	logger.Info().Msgf("Authorization successful. My name: %s/%s", me.User.Name, me.Name)
 
-	if err := saveAuthData(); err != nil {
+	if err := saveAuthData(token); err != nil {
 		return fmt.Errorf("unable to save authorization data: %w", err)
 	}
 	logger.Info().Msg("Authorization information saved")
@@ -173,9 +170,15 @@ func launchCmd(cmdParts []string) error {
 func browserAuth(ctx context.Context) (string, error) {
 	logger := log.Logger
 
+	cfg := config.Get()
 	logger.Info().Msg("Obtaining bootstrap URL")
-	logger.Debug().Msgf("Bootstrap request endpoint: %s", config.Cfg.Hive.Endpoint)
-	reqUrl, err := url.JoinPath(config.Cfg.Hive.Endpoint, "/api/agents/bootstrap")
+	logger.Debug().Msgf("Bootstrap request endpoint: %s", cfg.Hive.Endpoint)
+	// The completion request waits for the user, so there is no timeout
+	httpc, err := outbound.NewHTTPClient(cfg, 0)
+	if err != nil {
+		return "", err
+	}
+	reqUrl, err := url.JoinPath(cfg.Hive.Endpoint, "/api/agents/bootstrap")
 	if err != nil {
 		return "", err
 	}
@@ -185,7 +188,7 @@ func browserAuth(ctx context.Context) (string, error) {
 		return "", err
 	}
 
-	redirectResp, err := http.DefaultClient.Do(r)
+	redirectResp, err := httpc.Do(r)
 	if err != nil {
 		return "", err
 	}
@@ -207,7 +210,7 @@ func browserAuth(ctx context.Context) (string, error) {
 	logger.Debug().Interface("payload", redirect).Msg("received redirect event")
 	fmt.Printf("Please, open the following URL in your browser and follow instructions: %s\n", redirect.RedirectURL)
 
-	reqUrl, err = url.JoinPath(config.Cfg.Hive.Endpoint, "/api/agents/bootstrap/", redirect.BootstrapToken)
+	reqUrl, err = url.JoinPath(cfg.Hive.Endpoint, "/api/agents/bootstrap/", redirect.BootstrapToken)
 	if err != nil {
 		return "", err
 	}
@@ -216,7 +219,7 @@ func browserAuth(ctx context.Context) (string, error) {
 		return "", err
 	}
 
-	resultResp, err := http.DefaultClient.Do(r)
+	resultResp, err := httpc.Do(r)
 	if err != nil {
 		logger.Err(err).Msg("failed to complete bootstrap request")
 		return "", err
@@ -272,10 +275,12 @@ func askCreds(ctx context.Context) (token string, err error) {
 }
 
 func whoami(ctx context.Context, token string) (*api_models.WhoamiResult, error) {
-	httpc := &http.Client{
-		Timeout: 5 * time.Second,
+	cfg := config.Get()
+	httpc, err := outbound.NewHTTPClient(cfg, 5*time.Second)
+	if err != nil {
+		return nil, err
 	}
-	url, err := url.JoinPath(config.Cfg.Hive.Endpoint, "/api/agents/whoami")
+	url, err := url.JoinPath(cfg.Hive.Endpoint, "/api/agents/whoami")
 	if err != nil {
 		return nil, err
 	}
@@ -307,23 +312,9 @@ func whoami(ctx context.Context, token string) (*api_models.WhoamiResult, error)
 	return me, nil
 }
 
-func saveAuthData() error {
-	authFileContent := struct {
-		AuthToken string `yaml:"auth_token"`
-	}{
-		AuthToken: config.Cfg.AuthToken,
-	}
-	out, err := yaml.Marshal(&authFileContent)
-	if err != nil {
-		return err
-	}
-	if err = os.MkdirAll(filepath.Dir(config.AuthFilepath), 0755); err != nil {
-		return err
-	}
-	if err = os.WriteFile(config.AuthFilepath, out, 0644); err != nil {
-		return err
-	}
-	return nil
+func saveAuthData(token string) error {
+	// A token refreshed by the daemon from the previous one is ignored from now on
+	return config.SaveAuthToken(config.AuthFilepath, token)
 }
 
 func checkLocalAuth() error {
@@ -0,0 +1,270 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+const rotatedSuffixFormat = "20060102T150405.000000"
+
+type Event string
+
+const (
+	// The tunnel is established. Written right away, so sessions open at a crash are still recorded
+	EventOpen Event = "open"
+	// The tunnel is closed, with the totals of the session
+	EventClose Event = "close"
+	// The tunnel was rejected before it was established
+	EventReject Event = "reject"
+)
+
+// Record describes a tunnel event
+type Record struct {
+	Event         Event     `json:"event"`
+	Cid           string    `json:"cid"`
+	ProxyEndpoint string    `json:"proxy_endpoint"`
+	Target        string    `json:"target"`
+	ClientAddr    string    `json:"client_addr,omitempty"`
+	OpenedAt      time.Time `json:"opened_at"`
+	ClosedAt      time.Time `json:"closed_at,omitzero"`
+	BytesIn       uint64    `json:"bytes_in"`
+	BytesOut      uint64    `json:"bytes_out"`
+	CloseReason   string    `json:"close_reason,omitempty"`
+}
+
+// Logger writes audit records as JSON lines and rotates the file by size
+type Logger struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	size       int64
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+	// Records are synced to disk in batches unless it's zero
+	syncInterval time.Duration
+	// Records are written but not synced yet
+	dirty bool
+	stop  chan struct{}
+}
+
+var (
+	// Held for reading while a record is written, so the logger is never closed under a writer
+	defaultMu     sync.RWMutex
+	defaultLogger *Logger
+)
+
+// Setup opens the audit log configured in the current config. Audit is disabled when the file is empty
+func Setup() error {
+	var logger *Logger
+	if cfg := config.Get().Audit; cfg.File != "" {
+		var err error
+		logger, err = Open(cfg)
+		if err != nil {
+			return err
+		}
+	}
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultLogger != nil {
+		defaultLogger.Close()
+	}
+	defaultLogger = logger
+	return nil
+}
+
+// Write stores the record to the audit log opened by Setup
+func Write(record Record) {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	if defaultLogger == nil {
+		return
+	}
+	if err := defaultLogger.Write(record); err != nil {
+		log.Err(err).Str("cid", record.Cid).Msg("unable to write audit record")
+	}
+}
+
+// Close closes the audit log opened by Setup
+func Close() {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultLogger != nil {
+		defaultLogger.Close()
+		defaultLogger = nil
+	}
+}
+
+func Open(cfg config.AuditConfigSection) (*Logger, error) {
+	l := &Logger{
+		path:         cfg.File,
+		maxSize:      cfg.MaxSize,
+		maxBackups:   cfg.MaxBackups,
+		maxAge:       cfg.MaxAge,
+		syncInterval: cfg.SyncInterval,
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0750); err != nil {
+		return nil, fmt.Errorf("unable to create audit log directory: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	if l.syncInterval > 0 {
+		l.stop = make(chan struct{})
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+// syncLoop syncs written records to disk every syncInterval until the logger is closed
+func (l *Logger) syncLoop() {
+	ticker := time.NewTicker(l.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		if l.file != nil {
+			if err := l.sync(); err != nil {
+				log.Err(err).Msg("unable to sync audit log")
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// sync flushes the written records of the current file to disk. Must be called with l.mu held
+func (l *Logger) sync() error {
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.file.Sync()
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %w", err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to stat audit log: %w", err)
+	}
+	l.file = f
+	l.size = stat.Size()
+	return nil
+}
+
+func (l *Logger) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			// Better an oversized file than lost records
+			log.Err(err).Msg("unable to rotate audit log, writing to the current file")
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.dirty = true
+	if l.syncInterval > 0 {
+		return nil
+	}
+	// Audit records must survive a power loss
+	return l.sync()
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	if l.stop != nil {
+		close(l.stop)
+	}
+	err := l.sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
+
+// rotate renames the current file and opens a new one.
+// The current file is closed only after that succeeds, so records keep going somewhere on failures.
+func (l *Logger) rotate() error {
+	rotated := l.path + "." + time.Now().UTC().Format(rotatedSuffixFormat)
+	if err := os.Rename(l.path, rotated); err != nil {
+		return fmt.Errorf("unable to rotate audit log: %w", err)
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	if l.dirty {
+		l.dirty = false
+		old.Sync()
+	}
+	old.Close()
+	l.cleanup()
+	return nil
+}
+
+// cleanup removes rotated files exceeding the retention settings
+func (l *Logger) cleanup() {
+	rotated, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return
+	}
+	prefix := l.path + "."
+	backups := []string{}
+	for _, path := range rotated {
+		if _, err := time.Parse(rotatedSuffixFormat, strings.TrimPrefix(path, prefix)); err == nil {
+			backups = append(backups, path)
+		}
+	}
+	// Newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	now := time.Now()
+	for i, path := range backups {
+		expired := l.maxBackups > 0 && i >= l.maxBackups
+		if !expired && l.maxAge > 0 {
+			if stat, err := os.Stat(path); err == nil && now.Sub(stat.ModTime()) > l.maxAge {
+				expired = true
+			}
+		}
+		if expired {
+			if err := os.Remove(path); err != nil {
+				log.Err(err).Str("file", path).Msg("unable to remove old audit log")
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// SaveAuthToken atomically writes the auth file, so the token is never lost halfway
+func SaveAuthToken(path string, token string) error {
+	authFileContent := struct {
+		AuthToken string `yaml:"auth_token"`
+	}{
+		AuthToken: token,
+	}
+	out, err := yaml.Marshal(&authFileContent)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, out, 0644)
+}
+
+// refreshedAuthFile ties the refreshed token to the token of the config files it was derived from,
+// so a new token written to AuthFilepath, e.g. by kvmd-cloudctl, takes precedence over it
+type refreshedAuthFile struct {
+	AuthToken     string `yaml:"auth_token"`
+	BaseTokenHash string `yaml:"base_token_sha256"`
+}
+
+func tokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetAuthToken replaces the token used for new connections and saves it to RefreshedAuthFilepath,
+// unless the token has changed since refreshedFrom was sent for the refresh, e.g. by a reload.
+// Returns whether the token has been replaced
+func SetAuthToken(refreshedFrom string, token string) (bool, error) {
+	replaced := false
+	var writeErr error
+	update(func(cfg *Config) error {
+		if cfg.AuthToken != refreshedFrom {
+			return nil
+		}
+		cfg.AuthToken = token
+		replaced = true
+		// Written under the update lock, so a token set meanwhile can't be overwritten by this one
+		out, err := yaml.Marshal(&refreshedAuthFile{
+			AuthToken:     token,
+			BaseTokenHash: cfg.baseTokenHash,
+		})
+		if err == nil {
+			err = WriteFileAtomic(RefreshedAuthFilepath, out, 0600)
+		}
+		writeErr = err
+		return nil
+	})
+	return replaced, writeErr
+}
+
+// loadRefreshedAuthToken returns the refreshed token if it was derived from baseToken, or an empty string
+func loadRefreshedAuthToken(path string, baseToken string) (string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	refreshed := refreshedAuthFile{}
+	if err := yaml.Unmarshal(data, &refreshed); err != nil {
+		return "", err
+	}
+	if refreshed.BaseTokenHash != tokenHash(baseToken) {
+		log.Debug().Str("file", path).Msg("Auth token has changed since the last refresh, ignoring the refreshed one")
+		return "", nil
+	}
+	return refreshed.AuthToken, nil
+}
+
+// WriteFileAtomic replaces the file with a fully written one, so a power loss never leaves it half-written
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pikvm/kvmd-cloud/internal/config/vars"
 )
@@ -16,9 +19,13 @@ type ConfigFile struct {
 const ExtractConfigNode = ""
 
 var (
-	ConfigFiles  = []ConfigFile{}
-	AuthFilepath = ""
-	EnvIsHere    = false
+	ConfigFiles      = []ConfigFile{}
+	AuthFilepath     = ""
+	ServicesFilepath = ""
+	EnvIsHere        = false
+	// Tokens refreshed by the daemon, which can't write to AuthFilepath.
+	// Overrides the token of AuthFilepath until a different one is written there
+	RefreshedAuthFilepath = ""
 )
 
 func init() {
@@ -27,34 +34,150 @@ func init() {
 	}
 	if _, err := os.Stat(".env/main.yaml"); vars.Debug && err == nil {
 		AuthFilepath = ".env/auth.yaml"
+		RefreshedAuthFilepath = ".env/auth-refreshed.yaml"
+		ServicesFilepath = ".env/services.yaml"
+		DefConfig.Audit.File = ".env/audit.jsonl"
+		DefConfig.Proxy.EndpointsCache.File = ".env/endpoints.json"
 		ConfigFiles = append(ConfigFiles, ConfigFile{Path: ".env/main.yaml", MustExist: false})
 	} else {
 		AuthFilepath = "/etc/kvmd/cloud/auth.yaml"
+		RefreshedAuthFilepath = "/var/lib/kvmd-cloud/auth.yaml"
+		ServicesFilepath = "/etc/kvmd/cloud/services.yaml"
 		ConfigFiles = append(ConfigFiles, ConfigFile{Path: "/etc/kvmd/cloud/main.yaml", MustExist: true})
 		ConfigFiles = append(ConfigFiles, ConfigFile{Path: "/etc/kvmd/cloud/override.yaml", MustExist: false})
 	}
+	ConfigFiles = append(ConfigFiles, ConfigFile{Path: ServicesFilepath, MustExist: false})
 	ConfigFiles = append(ConfigFiles, ConfigFile{Path: AuthFilepath, MustExist: false})
 }
 
 type Config struct {
-	AuthToken     string            `json:"auth_token" mapstructure:"auth_token"`
-	NoSSL         bool              `json:"nossl" mapstructure:"nossl"`
-	SSL           SSLConfigSection  `json:"ssl" mapstructure:"ssl"`
-	Hive          HiveConfigSection `json:"hive" mapstructure:"hive"`
-	UnixCtlSocket string            `json:"unix_ctl_socket" mapstructure:"unix_ctl_socket"`
-	Log           LogConfigSection  `json:"log" mapstructure:"log"`
+	AuthToken string `json:"auth_token" mapstructure:"auth_token"`
+	// Hash of the token of the config files, which refreshed tokens are derived from
+	baseTokenHash string
+	NoSSL         bool               `json:"nossl" mapstructure:"nossl"`
+	SSL           SSLConfigSection   `json:"ssl" mapstructure:"ssl"`
+	Hive          HiveConfigSection  `json:"hive" mapstructure:"hive"`
+	Proxy         ProxyConfigSection `json:"proxy" mapstructure:"proxy"`
+	UnixCtlSocket string             `json:"unix_ctl_socket" mapstructure:"unix_ctl_socket"`
+	// Corporate proxy for connections to the hive and the cloud proxies
+	OutboundProxy OutboundProxyConfigSection `json:"outbound_proxy" mapstructure:"outbound_proxy"`
+	// Refresh of short-lived auth tokens from the hive
+	TokenRefresh TokenRefreshConfigSection `json:"token_refresh" mapstructure:"token_refresh"`
+	// Reload the config when any of the config files changes. SIGHUP always reloads it
+	WatchConfig bool                `json:"watch_config" mapstructure:"watch_config"`
+	Log         LogConfigSection    `json:"log" mapstructure:"log"`
+	Tunnel      TunnelConfigSection `json:"tunnel" mapstructure:"tunnel"`
+	Audit       AuditConfigSection  `json:"audit" mapstructure:"audit"`
+	// Logical service names the proxy can use in connect_to instead of raw targets
+	Services map[string]ServiceConfig `json:"services" mapstructure:"services"`
 }
 
 type SSLConfigSection struct {
 	Ca string `json:"ca" mapstructure:"ca"`
-	// Cert string `json:"cert" mapstructure:"cert"`
-	// Key  string `json:"key" mapstructure:"key"`
+	// Client certificate and its key for the hive and the cloud proxies. A file path, file:path, env:VAR or plain:PEM.
+	// Files are reread when they change
+	Cert string `json:"cert" mapstructure:"cert"`
+	Key  string `json:"key" mapstructure:"key"`
+	// Public key pins of the hive and the proxies. Hosts matching none of the patterns are not pinned
+	Pins []CertPinConfig `json:"pins" mapstructure:"pins"`
+}
+
+type CertPinConfig struct {
+	// Hostname glob pattern, e.g. *.pikvm.cloud. The first matching entry is used
+	Host string `json:"host" mapstructure:"host"`
+	// Base64 SHA-256 hashes of SubjectPublicKeyInfo. Any certificate of the chain may match, so backup pins allow key rotation
+	Sha256 []string `json:"sha256" mapstructure:"sha256"`
 }
 
 type HiveConfigSection struct {
 	Endpoint string `json:"endpoint" mapstructure:"endpoint"`
 }
 
+type TokenRefreshConfigSection struct {
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Tokens with an expiry time are refreshed when they expire within this time
+	Window time.Duration `json:"window" mapstructure:"window"`
+	// Tokens without an expiry time are refreshed at this interval. Zero never refreshes them
+	Interval time.Duration `json:"interval" mapstructure:"interval"`
+}
+
+type OutboundProxyConfigSection struct {
+	// http://, https:// or socks5:// URL. Empty value uses HTTPS_PROXY and NO_PROXY environment variables
+	URL string `json:"url" mapstructure:"url"`
+	// Basic auth for HTTP proxies or username/password auth for SOCKS5. Override the credentials of URL
+	Username string `json:"username" mapstructure:"username"`
+	Password string `json:"password" mapstructure:"password" mold:"fieldLoader,trim"`
+	// Hosts connected directly, in NO_PROXY format. Used only with URL
+	NoProxy []string `json:"no_proxy" mapstructure:"no_proxy"`
+}
+
+type ProxyConfigSection struct {
+	// Static proxy endpoints. Depending on EndpointsMode they replace the hive list or are merged with it
+	Endpoints     []string      `json:"endpoints" mapstructure:"endpoints"`
+	EndpointsMode EndpointsMode `json:"endpoints_mode" mapstructure:"endpoints_mode"`
+	// Backoff between attempts to connect to a proxy or to get the proxy list from the hive
+	Reconnect ReconnectConfigSection `json:"reconnect" mapstructure:"reconnect"`
+	// Endpoints that keep failing are excluded for a while and reported to the hive
+	CircuitBreaker CircuitBreakerConfigSection `json:"circuit_breaker" mapstructure:"circuit_breaker"`
+	// New endpoints are requested from the hive when fewer endpoints are healthy.
+	// Circuits don't open if fewer endpoints would be left
+	MinHealthyEndpoints int `json:"min_healthy_endpoints" mapstructure:"min_healthy_endpoints"`
+	// Application level probes detecting dead links and measuring RTT
+	Keepalive KeepaliveConfigSection `json:"keepalive" mapstructure:"keepalive"`
+	// Which of the endpoints offered by the hive to connect to
+	Selection SelectionConfigSection `json:"selection" mapstructure:"selection"`
+	// The last endpoint list received from the hive, used at startup while the hive is unreachable
+	EndpointsCache EndpointsCacheConfigSection `json:"endpoints_cache" mapstructure:"endpoints_cache"`
+}
+
+type EndpointsCacheConfigSection struct {
+	// Empty value disables the cache
+	File string `json:"file" mapstructure:"file"`
+	// Older cache is ignored. Zero means no limit
+	MaxAge time.Duration `json:"max_age" mapstructure:"max_age"`
+}
+
+type SelectionConfigSection struct {
+	// "all" connects to every endpoint, "best" only to Count endpoints with the fastest handshake
+	Mode  SelectionMode `json:"mode" mapstructure:"mode"`
+	Count int           `json:"count" mapstructure:"count"`
+	// Connected endpoints are kept unless another one is faster by this fraction
+	Hysteresis   float64       `json:"hysteresis" mapstructure:"hysteresis"`
+	ProbeTimeout time.Duration `json:"probe_timeout" mapstructure:"probe_timeout"`
+}
+
+type KeepaliveConfigSection struct {
+	// Zero disables probes
+	Interval time.Duration `json:"interval" mapstructure:"interval"`
+	// Probe without a reply within this time is missed
+	Timeout time.Duration `json:"timeout" mapstructure:"timeout"`
+	// Missed probes in a row after which the connection is dropped. Zero never drops it.
+	// Misses are counted only after the first reply, so proxies without common.Ping are never dropped.
+	// They are not probed anymore after this many probes without a reply
+	MissThreshold int `json:"miss_threshold" mapstructure:"miss_threshold"`
+}
+
+type CircuitBreakerConfigSection struct {
+	// Consecutive connect failures that open the circuit. Zero disables the check
+	FailureThreshold int `json:"failure_threshold" mapstructure:"failure_threshold"`
+	// Unexpected session drops within DropWindow that open the circuit. Zero disables the check
+	DropThreshold int           `json:"drop_threshold" mapstructure:"drop_threshold"`
+	DropWindow    time.Duration `json:"drop_window" mapstructure:"drop_window"`
+	// How long the endpoint stays excluded before a trial connection
+	Cooldown time.Duration `json:"cooldown" mapstructure:"cooldown"`
+}
+
+type ReconnectConfigSection struct {
+	InitialInterval time.Duration `json:"initial_interval" mapstructure:"initial_interval"`
+	MaxInterval     time.Duration `json:"max_interval" mapstructure:"max_interval"`
+	// Each next interval is multiplied by this value until MaxInterval is reached
+	Multiplier float64 `json:"multiplier" mapstructure:"multiplier"`
+	// Random deviation of the interval as a fraction of it
+	Jitter float64 `json:"jitter" mapstructure:"jitter"`
+	// Backoff starts over if the lost connection has been up at least this long. Zero disables the reset
+	ResetAfter time.Duration `json:"reset_after" mapstructure:"reset_after"`
+}
+
 type LogConfigSection struct {
 	Level  string    `json:"level" mapstructure:"level"`
 	File   string    `json:"file" mapstructure:"file"`
@@ -63,22 +186,206 @@ type LogConfigSection struct {
 	Trace  bool      `json:"trace" mapstructure:"trace"`
 }
 
+type TunnelConfigSection struct {
+	// Unix socket paths the proxy is allowed to connect to. Glob patterns are supported
+	AllowedUnixSockets []string `json:"allowed_unix_sockets" mapstructure:"allowed_unix_sockets"`
+	// TCP targets the proxy is allowed to connect to in host:port form. Glob patterns are supported for both parts
+	AllowedTCPTargets []string `json:"allowed_tcp_targets" mapstructure:"allowed_tcp_targets"`
+	// Timeout for connecting to the target
+	DialTimeout time.Duration `json:"dial_timeout" mapstructure:"dial_timeout"`
+	// Max time to wait for the stream header from the proxy
+	HeaderTimeout time.Duration `json:"header_timeout" mapstructure:"header_timeout"`
+	// Max time to wait for the proxy to finish its side after the inner connection has ended. Only for proxies supporting half-close
+	Linger time.Duration `json:"linger" mapstructure:"linger"`
+	// Max time to let active tunnels finish when a proxy connection is closed or the agent stops. Zero closes them at once
+	DrainTimeout time.Duration `json:"drain_timeout" mapstructure:"drain_timeout"`
+	// Tunnels without traffic are closed after these timeouts. Zero disables the check
+	IdleTimeout IdleTimeoutConfigSection `json:"idle_timeout" mapstructure:"idle_timeout"`
+	// Bandwidth limits for tunneled traffic
+	Bandwidth BandwidthConfigSection `json:"bandwidth" mapstructure:"bandwidth"`
+	// Max concurrent tunnels of the agent. Zero means unlimited
+	MaxTunnels int `json:"max_tunnels" mapstructure:"max_tunnels"`
+	// Max concurrent tunnels of a single proxy connection. Zero means unlimited
+	MaxTunnelsPerProxy int `json:"max_tunnels_per_proxy" mapstructure:"max_tunnels_per_proxy"`
+	// Targets that expect a PROXY protocol header at the beginning of the connection
+	ProxyProtocol []ProxyProtocolTarget `json:"proxy_protocol" mapstructure:"proxy_protocol"`
+	// Max new tunnels per second. Zero means unlimited
+	NewTunnelsRate float64 `json:"new_tunnels_rate" mapstructure:"new_tunnels_rate"`
+	// Max burst of new tunnels above the rate
+	NewTunnelsBurst int `json:"new_tunnels_burst" mapstructure:"new_tunnels_burst"`
+}
+
+type ProxyProtocolTarget struct {
+	// Unix socket path or TCP host:port. Glob patterns are supported
+	Target string `json:"target" mapstructure:"target"`
+	// PROXY protocol version: 1 or 2
+	Version int `json:"version" mapstructure:"version"`
+}
+
+type IdleTimeoutConfigSection struct {
+	// No data from the inner socket to the proxy
+	Upload time.Duration `json:"upload" mapstructure:"upload"`
+	// No data from the proxy to the inner socket
+	Download time.Duration `json:"download" mapstructure:"download"`
+}
+
+type BandwidthConfigSection struct {
+	// Limits shared by all tunnels of the agent
+	Global BandwidthLimits `json:"global" mapstructure:"global"`
+	// Limits shared by all tunnels of a single proxy connection
+	PerProxy BandwidthLimits `json:"per_proxy" mapstructure:"per_proxy"`
+	// Limits of each tunnel
+	PerTunnel BandwidthLimits `json:"per_tunnel" mapstructure:"per_tunnel"`
+}
+
+// BandwidthLimits are in bytes per second. Zero means unlimited
+type BandwidthLimits struct {
+	// Inner socket -> proxy
+	Upload int64 `json:"upload" mapstructure:"upload"`
+	// Proxy -> inner socket
+	Download int64 `json:"download" mapstructure:"download"`
+}
+
+type ServiceConfig struct {
+	// Disabled services are neither announced to the cloud nor reachable through it
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Unix socket path or TCP host:port
+	Target string `json:"target" mapstructure:"target"`
+}
+
+type AuditConfigSection struct {
+	// JSON lines file with records of every tunnel. Empty value disables the audit log
+	File string `json:"file" mapstructure:"file"`
+	// The file is rotated when it grows over this size in bytes. Zero disables rotation
+	MaxSize int64 `json:"max_size" mapstructure:"max_size"`
+	// Max number of rotated files to keep. Zero means unlimited
+	MaxBackups int `json:"max_backups" mapstructure:"max_backups"`
+	// Rotated files older than this are removed. Zero means unlimited
+	MaxAge time.Duration `json:"max_age" mapstructure:"max_age"`
+	// Written records are synced to disk this often. Zero syncs every record
+	SyncInterval time.Duration `json:"sync_interval" mapstructure:"sync_interval"`
+}
+
 var DefConfig = Config{
+	SSL: SSLConfigSection{
+		Pins: []CertPinConfig{},
+	},
 	Hive: HiveConfigSection{
 		Endpoint: "https://pikvm.cloud",
 	},
+	Proxy: ProxyConfigSection{
+		Endpoints:     []string{},
+		EndpointsMode: EndpointsModeReplace,
+		Reconnect: ReconnectConfigSection{
+			InitialInterval: 1 * time.Second,
+			MaxInterval:     30 * time.Second,
+			Multiplier:      2,
+			Jitter:          0.25,
+			ResetAfter:      1 * time.Minute,
+		},
+		CircuitBreaker: CircuitBreakerConfigSection{
+			FailureThreshold: 5,
+			DropThreshold:    3,
+			DropWindow:       10 * time.Minute,
+			Cooldown:         10 * time.Minute,
+		},
+		MinHealthyEndpoints: 1,
+		Keepalive: KeepaliveConfigSection{
+			Interval:      15 * time.Second,
+			Timeout:       5 * time.Second,
+			MissThreshold: 3,
+		},
+		Selection: SelectionConfigSection{
+			Mode:         SelectionModeAll,
+			Count:        2,
+			Hysteresis:   0.3,
+			ProbeTimeout: 5 * time.Second,
+		},
+		EndpointsCache: EndpointsCacheConfigSection{
+			File:   "/var/lib/kvmd-cloud/endpoints.json",
+			MaxAge: 7 * 24 * time.Hour,
+		},
+	},
+	OutboundProxy: OutboundProxyConfigSection{
+		NoProxy: []string{},
+	},
+	TokenRefresh: TokenRefreshConfigSection{
+		Enabled: true,
+		Window:  1 * time.Hour,
+	},
 	UnixCtlSocket: "/run/kvmd/cloud-ctl.sock",
 	Log: LogConfigSection{
 		Level:  "info",
 		File:   "-",
 		Format: LogFormatText,
 	},
+	Tunnel: TunnelConfigSection{
+		AllowedUnixSockets: []string{
+			"/run/kvmd/cloud-nginx-http.sock",
+			"/run/kvmd/cloud-nginx-https.sock",
+			"/run/kvmd/cloud-nginx-http-pp.sock",
+			"/run/kvmd/cloud-nginx-https-pp.sock",
+		},
+		AllowedTCPTargets: []string{},
+		DialTimeout:       5 * time.Second,
+		HeaderTimeout:     10 * time.Second,
+		Linger:            10 * time.Second,
+		DrainTimeout:      30 * time.Second,
+		IdleTimeout: IdleTimeoutConfigSection{
+			Upload:   1 * time.Hour,
+			Download: 1 * time.Hour,
+		},
+		// Services get the real client address only if they are retargeted to these sockets
+		ProxyProtocol: []ProxyProtocolTarget{
+			{Target: "/run/kvmd/cloud-nginx-http-pp.sock", Version: 2},
+			{Target: "/run/kvmd/cloud-nginx-https-pp.sock", Version: 2},
+		},
+		MaxTunnels:         64,
+		MaxTunnelsPerProxy: 32,
+		NewTunnelsRate:     10,
+		NewTunnelsBurst:    20,
+	},
+	Audit: AuditConfigSection{
+		File:         "/var/log/kvmd-cloud/audit.jsonl",
+		MaxSize:      10 * 1024 * 1024,
+		MaxBackups:   10,
+		MaxAge:       90 * 24 * time.Hour,
+		SyncInterval: 1 * time.Second,
+	},
+	Services: map[string]ServiceConfig{
+		"web":           {Enabled: true, Target: "/run/kvmd/cloud-nginx-https.sock"},
+		"http-redirect": {Enabled: true, Target: "/run/kvmd/cloud-nginx-http.sock"},
+		"vnc":           {Enabled: false, Target: "127.0.0.1:5900"},
+		"ssh":           {Enabled: false, Target: "127.0.0.1:22"},
+	},
 }
 
-var Cfg *Config = nil
+// current is replaced as a whole on reloads and runtime changes, it's never modified in place
+var current atomic.Pointer[Config]
+
+// updateMu serializes the changes of current
+var updateMu sync.Mutex
+
+// Get returns the current config. It may be replaced at any moment,
+// so an operation should get it once and keep using that snapshot.
+func Get() *Config {
+	return current.Load()
+}
+
+// update replaces the current config with a modified copy. The copy is shallow, so maps must be cloned before changes
+func update(modify func(cfg *Config) error) error {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	cfg := *current.Load()
+	if err := modify(&cfg); err != nil {
+		return err
+	}
+	current.Store(&cfg)
+	return nil
+}
 
 func DumpConfig() error {
-	s, err := json.MarshalIndent(Cfg, "", "  ")
+	s, err := json.MarshalIndent(Get(), "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
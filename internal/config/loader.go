@@ -1,8 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/knadh/koanf/maps"
 	"github.com/knadh/koanf/parsers/yaml"
@@ -36,14 +38,27 @@ func subtreeMerger(subtree string, strict bool) func(src, dest map[string]any) e
 // LoadConfig loads configuration from files and CLI flags, and sets up the logger.
 // It will terminate the program on errors.
 func LoadConfig(cmd *cli.Command) {
+	cfg, err := ReadConfig(cmd)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to load config")
+		return
+	}
+	if _, err := ApplyConfig(cfg); err != nil {
+		log.Fatal().Err(err).Msg("Unable to apply config")
+		return
+	}
+	// DumpConfig()
+}
+
+// ReadConfig loads configuration from files and CLI flags without applying it
+func ReadConfig(cmd *cli.Command) (*Config, error) {
 	strict := false
 	k := koanf.NewWithConf(koanf.Conf{
 		Delim:       ".",
 		StrictMerge: strict,
 	})
 	if err := k.Load(structs.Provider(DefConfig, "json"), nil); err != nil {
-		log.Fatal().Err(err).Msg("Unable to load default config")
-		return
+		return nil, fmt.Errorf("unable to load default config: %w", err)
 	}
 
 	var cfg Config
@@ -63,68 +78,127 @@ func LoadConfig(cmd *cli.Command) {
 		if stat, err := os.Stat(configFile.Path); err == nil && stat.Mode().IsRegular() {
 			log.Debug().Str("file", configFile.Path).Msg("Loading config file")
 			if err := k.Load(file.Provider(configFile.Path), yaml.Parser(), mergerOpts...); err != nil {
-				log.Fatal().Err(err).Str("file", configFile.Path).Msg("Unable to load config file")
-				return
+				return nil, fmt.Errorf("unable to load config file %s: %w", configFile.Path, err)
 			}
 			log.Debug().Str("file", configFile.Path).Msg("Loaded config file")
 		} else if configFile.MustExist {
-			log.Fatal().Err(err).Str("file", configFile.Path).Msg("Config file does not exist or is not a regular file")
-			return
+			if err == nil {
+				err = fmt.Errorf("not a regular file")
+			}
+			return nil, fmt.Errorf("config file %s does not exist or is not a regular file: %w", configFile.Path, err)
+		}
+	}
+
+	// The refreshed token is runtime state rather than config, so it's used with any config files
+	baseToken := k.String("auth_token")
+	if refreshedToken, err := loadRefreshedAuthToken(RefreshedAuthFilepath, baseToken); err != nil {
+		return nil, fmt.Errorf("unable to load refreshed auth token %s: %w", RefreshedAuthFilepath, err)
+	} else if refreshedToken != "" {
+		if err := k.Set("auth_token", refreshedToken); err != nil {
+			return nil, fmt.Errorf("unable to set refreshed auth token: %w", err)
 		}
 	}
 
 	const FLAGS_DELIM = "-"
 	mergerOpts = []koanf.Option{koanf.WithMergeFunc(flagsMerger(cmd, FLAGS_DELIM, strict))}
 	if err := k.Load(cliflagv3.Provider(cmd, FLAGS_DELIM), nil, mergerOpts...); err != nil {
-		log.Fatal().Err(err).Msg("Unable to load CLI flags")
-		return
+		return nil, fmt.Errorf("unable to load CLI flags: %w", err)
 	}
 
 	if err := k.UnmarshalWithConf("", &cfg, koanf.UnmarshalConf{Tag: "json"}); err != nil {
-		log.Fatal().Err(err).Msg("Unable to unmarshal default config")
-		return
+		return nil, fmt.Errorf("unable to unmarshal config: %w", err)
 	}
 
+	cfg.baseTokenHash = tokenHash(baseToken)
+
 	if err := configPostProcess(&cfg); err != nil {
-		log.Fatal().Err(err).Msg("Config post-processing failed")
-		return
+		return nil, fmt.Errorf("config post-processing failed: %w", err)
 	}
-	Cfg = &cfg
-	// DumpConfig()
-
-	setupLogger()
+	if _, err := zerolog.ParseLevel(cfg.Log.Level); err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
+	}
+	return &cfg, nil
 }
 
-func setupLogger() {
-	level, err := zerolog.ParseLevel(Cfg.Log.Level)
+// ApplyConfig replaces the current config and sets up the logger. On errors the current config is kept.
+// Returns the previous config.
+func ApplyConfig(cfg *Config) (*Config, error) {
+	writer, file, err := openLogWriter(cfg.Log)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Invalid log level")
-		return
+		return nil, err
 	}
-	zerolog.SetGlobalLevel(level)
-	zerolog.TimeFieldFormat = logTimeFormat
 
+	updateMu.Lock()
+	old := current.Swap(cfg)
+	updateMu.Unlock()
+
+	setupLogger(cfg.Log, writer, file, old == nil)
+	return old, nil
+}
+
+// logWriter lets loggers derived before a reload write to the new destination
+type logWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+var logOutput = &logWriter{w: os.Stderr}
+
+func (l *logWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+func (l *logWriter) swap(w io.Writer, file *os.File) {
+	l.mu.Lock()
+	old := l.file
+	l.w = w
+	l.file = file
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+func openLogWriter(logCfg LogConfigSection) (io.Writer, *os.File, error) {
 	var writer io.Writer
-	if Cfg.Log.File == "-" {
+	var f *os.File
+	if logCfg.File == "-" {
 		writer = os.Stderr
 	} else {
-		f, err := os.OpenFile(Cfg.Log.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		var err error
+		f, err = os.OpenFile(logCfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Unable to open log file")
-			return
+			return nil, nil, fmt.Errorf("unable to open log file: %w", err)
 		}
-		if Cfg.Log.Tee {
+		if logCfg.Tee {
 			writer = zerolog.MultiLevelWriter(os.Stderr, f)
 		} else {
 			writer = f
 		}
 	}
-	if Cfg.Log.Format == LogFormatText {
-		writer = zerolog.ConsoleWriter{Out: writer, TimeFormat: zerolog.TimeFieldFormat}
+	if logCfg.Format == LogFormatText {
+		writer = zerolog.ConsoleWriter{Out: writer, TimeFormat: logTimeFormat}
+	}
+	return writer, f, nil
+}
+
+// setupLogger replaces the global logger only on the first call, because goroutines read it without locking.
+// Later calls switch the level and the destination only.
+func setupLogger(logCfg LogConfigSection, writer io.Writer, file *os.File, first bool) {
+	level, _ := zerolog.ParseLevel(logCfg.Level)
+	zerolog.SetGlobalLevel(level)
+	logOutput.swap(writer, file)
+	if !first {
+		return
 	}
 
-	newLoggerContext := zerolog.New(writer).With().Timestamp()
-	if Cfg.Log.Trace {
+	zerolog.TimeFieldFormat = logTimeFormat
+
+	newLoggerContext := zerolog.New(logOutput).With().Timestamp()
+	if logCfg.Trace {
 		newLoggerContext = newLoggerContext.Caller()
 	}
 	log.Logger = newLoggerContext.Logger()
@@ -17,19 +17,28 @@ func configPostProcess(cfg *Config) error {
 }
 
 func fieldLoader(ctx context.Context, fl mold.FieldLevel) error {
-	val := fl.Field().String()
+	val, err := LoadFieldValue(fl.Field().String())
+	if err != nil {
+		return err
+	}
+	fl.Field().SetString(val)
+	return nil
+}
+
+// LoadFieldValue resolves file:, env: and plain: prefixes of a config value. Values without a prefix are returned as is
+func LoadFieldValue(val string) (string, error) {
 	if path, ok := strings.CutPrefix(val, "file:"); ok {
 		data, err := os.ReadFile(path)
 		if err != nil {
-			return fmt.Errorf("failed to read file %s: %w", path, err)
+			return "", fmt.Errorf("failed to read file %s: %w", path, err)
 		}
-		fl.Field().SetString(string(data))
+		return string(data), nil
 	} else if envVar, ok := strings.CutPrefix(val, "env:"); ok {
-		fl.Field().SetString(os.Getenv(envVar))
+		return os.Getenv(envVar), nil
 	} else if plain, ok := strings.CutPrefix(val, "plain:"); ok {
-		fl.Field().SetString(plain)
+		return plain, nil
 	}
-	return nil
+	return val, nil
 }
 
 func fieldTrim(ctx context.Context, fl mold.FieldLevel) error {
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// LookupService returns the service config by its logical name
+func LookupService(name string) (ServiceConfig, bool) {
+	service, ok := Get().Services[name]
+	return service, ok
+}
+
+// ListServices returns a copy of all configured services
+func ListServices() map[string]ServiceConfig {
+	return maps.Clone(Get().Services)
+}
+
+// EnabledServiceNames returns sorted names of enabled services
+func (c *Config) EnabledServiceNames() []string {
+	names := []string{}
+	for name, service := range c.Services {
+		if service.Enabled {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// SetServiceEnabled enables or disables a configured service at runtime. Returns whether the state has changed
+func SetServiceEnabled(name string, enabled bool) (bool, error) {
+	changed := false
+	err := update(func(cfg *Config) error {
+		service, ok := cfg.Services[name]
+		if !ok {
+			return fmt.Errorf("service %q is not configured", name)
+		}
+		if service.Enabled == enabled {
+			return nil
+		}
+		service.Enabled = enabled
+		cfg.Services = maps.Clone(cfg.Services)
+		cfg.Services[name] = service
+		changed = true
+		return nil
+	})
+	return changed, err
+}
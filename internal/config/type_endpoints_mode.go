@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+type EndpointsMode int
+
+const (
+	EndpointsModeReplace EndpointsMode = iota
+	EndpointsModeMerge
+)
+
+var (
+	endpointsModeEnumToString = map[EndpointsMode]string{
+		EndpointsModeReplace: "replace",
+		EndpointsModeMerge:   "merge",
+	}
+
+	endpointsModeStringToEnum = map[string]EndpointsMode{
+		"replace": EndpointsModeReplace,
+		"merge":   EndpointsModeMerge,
+	}
+)
+
+func (e *EndpointsMode) String() string {
+	return endpointsModeEnumToString[*e]
+}
+
+func (e *EndpointsMode) MarshalText() ([]byte, error) {
+	str, ok := endpointsModeEnumToString[*e]
+	if !ok {
+		return nil, fmt.Errorf("invalid EndpointsMode value: %d", *e)
+	}
+	return []byte(str), nil
+}
+
+func (e *EndpointsMode) UnmarshalText(text []byte) error {
+	s := strings.ToLower(string(text))
+	val, ok := endpointsModeStringToEnum[s]
+	if !ok {
+		return fmt.Errorf("invalid endpoints mode value: %s", s)
+	}
+	*e = val
+	return nil
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+type SelectionMode int
+
+const (
+	SelectionModeAll SelectionMode = iota
+	SelectionModeBest
+)
+
+var (
+	selectionModeEnumToString = map[SelectionMode]string{
+		SelectionModeAll:  "all",
+		SelectionModeBest: "best",
+	}
+
+	selectionModeStringToEnum = map[string]SelectionMode{
+		"all":  SelectionModeAll,
+		"best": SelectionModeBest,
+	}
+)
+
+func (e *SelectionMode) String() string {
+	return selectionModeEnumToString[*e]
+}
+
+func (e *SelectionMode) MarshalText() ([]byte, error) {
+	str, ok := selectionModeEnumToString[*e]
+	if !ok {
+		return nil, fmt.Errorf("invalid SelectionMode value: %d", *e)
+	}
+	return []byte(str), nil
+}
+
+func (e *SelectionMode) UnmarshalText(text []byte) error {
+	s := strings.ToLower(string(text))
+	val, ok := selectionModeStringToEnum[s]
+	if !ok {
+		return fmt.Errorf("invalid selection mode value: %s", s)
+	}
+	*e = val
+	return nil
+}
@@ -1,7 +1,82 @@
 package ctl
 
+import "time"
+
 type ApplicationStatusResponse struct {
-	PingerField string `json:"pinger"`
+	PingerField string                           `json:"pinger"`
+	Bandwidth   BandwidthStatus                  `json:"bandwidth"`
+	Admission   AdmissionStatus                  `json:"admission"`
+	Proxies     map[string]ProxyConnectionStatus `json:"proxies"`
+	Draining    []DrainStatus                    `json:"draining"`
+	Endpoints   map[string]EndpointHealthStatus  `json:"endpoints"`
+	PinFailures []PinFailureStatus               `json:"pinFailures"`
+}
+
+// PinFailureStatus is the last certificate pin mismatch of a host that hasn't passed the check since
+type PinFailureStatus struct {
+	Host  string    `json:"host"`
+	Error string    `json:"error"`
+	At    time.Time `json:"at"`
+	Count uint64    `json:"count"`
+}
+
+type EndpointHealthStatus struct {
+	Score               int           `json:"score"` // 0..100
+	Circuit             string        `json:"circuit"`
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	RecentDrops         int           `json:"recentDrops"`
+	Rtt                 time.Duration `json:"rtt"`
+	OpenUntil           *time.Time    `json:"openUntil,omitempty"`
+}
+
+type DrainStatus struct {
+	Endpoint      string    `json:"endpoint"`
+	ActiveTunnels int64     `json:"activeTunnels"`
+	StartedAt     time.Time `json:"startedAt"`
+	// Nil while waiting for the tunnels to finish on their own
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+type ProxyConnectionStatus struct {
+	State          string     `json:"state"`
+	Attempts       int        `json:"attempts"`
+	LastError      string     `json:"lastError,omitempty"`
+	ConnectedSince *time.Time `json:"connectedSince,omitempty"`
+	NextRetryAt    *time.Time `json:"nextRetryAt,omitempty"`
+	// Keepalive probes
+	Rtt              time.Duration `json:"rtt"`
+	RttJitter        time.Duration `json:"rttJitter"`
+	ProbeMisses      int           `json:"probeMisses"`
+	TotalProbeMisses uint64        `json:"totalProbeMisses"`
+	LastProbeAt      *time.Time    `json:"lastProbeAt,omitempty"`
+}
+
+type AdmissionStatus struct {
+	Global  TunnelLimiterStatus            `json:"global"`
+	Proxies map[string]TunnelLimiterStatus `json:"proxies"`
+}
+
+type TunnelLimiterStatus struct {
+	Active              int64  `json:"active"`
+	MaxActive           int64  `json:"maxActive"` // 0 means unlimited
+	RejectedTooMany     uint64 `json:"rejectedTooMany"`
+	RejectedRateLimited uint64 `json:"rejectedRateLimited"`
+}
+
+type BandwidthStatus struct {
+	Global  BandwidthShaperStatus            `json:"global"`
+	Proxies map[string]BandwidthShaperStatus `json:"proxies"`
+}
+
+type BandwidthShaperStatus struct {
+	Upload   BandwidthLimiterStatus `json:"upload"`
+	Download BandwidthLimiterStatus `json:"download"`
+}
+
+type BandwidthLimiterStatus struct {
+	Limit          int64         `json:"limit"` // bytes per second, 0 means unlimited
+	Throttling     bool          `json:"throttling"`
+	ThrottledTotal time.Duration `json:"throttledTotal"`
 }
 
 type CertbotDomainName struct {
@@ -13,3 +88,49 @@ type CertbotResponse struct {
 	Ok    bool   `json:"ok"`
 	Error string `json:"error"`
 }
+
+type TunnelInfo struct {
+	Cid           string    `json:"cid"`
+	Target        string    `json:"target"`
+	ProxyEndpoint string    `json:"proxyEndpoint"`
+	StartedAt     time.Time `json:"startedAt"`
+	BytesIn       uint64    `json:"bytesIn"`
+	BytesOut      uint64    `json:"bytesOut"`
+	LastActivity  time.Time `json:"lastActivity"`
+}
+
+type ConnectionsResponse struct {
+	Connections []TunnelInfo `json:"connections"`
+}
+
+type KillConnectionsRequest struct {
+	Cid         string `json:"cid"`
+	All         bool   `json:"all"`
+	RequestedBy string `json:"requestedBy"`
+}
+
+type KillConnectionsResponse struct {
+	Ok     bool     `json:"ok"`
+	Error  string   `json:"error"`
+	Killed []string `json:"killed"`
+}
+
+type ServiceInfo struct {
+	Name    string `json:"name"`
+	Target  string `json:"target"`
+	Enabled bool   `json:"enabled"`
+}
+
+type ServicesResponse struct {
+	Services []ServiceInfo `json:"services"`
+}
+
+type SetServiceRequest struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+type SetServiceResponse struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+}
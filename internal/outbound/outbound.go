@@ -0,0 +1,232 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+var defaultPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
+}
+
+// Dialer connects to remote hosts directly or through the outbound proxy.
+// Every connection is tunneled, so HTTP proxies must allow CONNECT to the ports of the hive and the cloud proxies.
+type Dialer struct {
+	proxyFunc func(*url.URL) (*url.URL, error)
+	user      *url.Userinfo
+	direct    net.Dialer
+}
+
+func NewDialer(cfg config.OutboundProxyConfigSection) (*Dialer, error) {
+	d := &Dialer{
+		direct: net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+	if cfg.URL == "" {
+		d.proxyFunc = httpproxy.FromEnvironment().ProxyFunc()
+		return d, nil
+	}
+
+	proxyURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound proxy url: %w", err)
+	}
+	if _, ok := defaultPorts[proxyURL.Scheme]; !ok {
+		return nil, fmt.Errorf("unsupported outbound proxy scheme %q, expected http, https or socks5", proxyURL.Scheme)
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, fmt.Errorf("outbound proxy url has no host: %s", cfg.URL)
+	}
+	if cfg.Username != "" {
+		d.user = url.UserPassword(cfg.Username, cfg.Password)
+	}
+	d.proxyFunc = (&httpproxy.Config{
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    strings.Join(cfg.NoProxy, ","),
+	}).ProxyFunc()
+	return d, nil
+}
+
+// ProxyFor returns the outbound proxy used for addr, or nil if addr is connected directly
+func (d *Dialer) ProxyFor(addr string) (*url.URL, error) {
+	proxyURL, err := d.proxyFunc(&url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound proxy: %w", err)
+	}
+	if proxyURL != nil && d.user != nil {
+		// The returned URL is shared by all calls
+		withUser := *proxyURL
+		withUser.User = d.user
+		return &withUser, nil
+	}
+	return proxyURL, nil
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	proxyURL, err := d.ProxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return d.direct.DialContext(ctx, network, addr)
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		return d.dialSOCKS5(ctx, proxyURL, network, addr)
+	case "http", "https":
+		return d.dialConnect(ctx, proxyURL, addr)
+	}
+	return nil, fmt.Errorf("unsupported outbound proxy scheme %q, expected http, https or socks5", proxyURL.Scheme)
+}
+
+// Transport returns an HTTP transport connecting through the dialer
+func (d *Dialer) Transport(tlsConfig *tls.Config) *http.Transport {
+	transport := &http.Transport{
+		DialContext:     d.DialContext,
+		IdleConnTimeout: 90 * time.Second,
+		MaxIdleConns:    10,
+	}
+	if tlsConfig != nil {
+		transport.DialTLSContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return d.DialTLS(ctx, network, addr, tlsConfig)
+		}
+	}
+	return transport
+}
+
+// DialTLS connects to addr through the dialer and does the TLS handshake with the config for its host
+func (d *Dialer) DialTLS(ctx context.Context, network string, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, ForHost(tlsConfig, host))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// NewHTTPClient returns an HTTP client for requests to the hive. Zero timeout means no timeout
+func NewHTTPClient(cfg *config.Config, timeout time.Duration) (*http.Client, error) {
+	d, err := NewDialer(cfg.OutboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := TLSConfig(cfg.SSL)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: d.Transport(tlsConfig),
+	}, nil
+}
+
+func (d *Dialer) dialSOCKS5(ctx context.Context, proxyURL *url.URL, network string, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+	// The target host is always resolved by the proxy, as with socks5h
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr(proxyURL), auth, &d.direct)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("outbound proxy %s: %w", proxyURL.Redacted(), err)
+	}
+	return conn, nil
+}
+
+func (d *Dialer) dialConnect(ctx context.Context, proxyURL *url.URL, addr string) (_ net.Conn, err error) {
+	conn, err := d.direct.DialContext(ctx, "tcp", proxyAddr(proxyURL))
+	if err != nil {
+		return nil, fmt.Errorf("outbound proxy %s: %w", proxyURL.Redacted(), err)
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	// The handshake with the proxy must not outlive ctx
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+		conn.SetDeadline(time.Time{})
+	}()
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("outbound proxy %s: %w", proxyURL.Redacted(), err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("outbound proxy %s: %w", proxyURL.Redacted(), err)
+	}
+	// The server speaks only after the client, so nothing past the response is buffered
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, fmt.Errorf("outbound proxy %s: %w", proxyURL.Redacted(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("outbound proxy %s refused to connect to %s: %s", proxyURL.Redacted(), addr, resp.Status)
+	}
+	return conn, nil
+}
+
+func proxyAddr(proxyURL *url.URL) string {
+	port := proxyURL.Port()
+	if port == "" {
+		port = defaultPorts[proxyURL.Scheme]
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
@@ -0,0 +1,132 @@
+package outbound
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// PinMismatchError means that no certificate of the verified chain has a pinned key
+type PinMismatchError struct {
+	Host string
+	// Pins of the chain presented by the host
+	Got []string
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("certificate pin mismatch for %s: none of the chain keys %s is pinned", e.Host, strings.Join(e.Got, ", "))
+}
+
+// PinFailure is the last pin mismatch of a host. It's forgotten once the host passes the check
+type PinFailure struct {
+	Host  string
+	Error string
+	At    time.Time
+	Count uint64
+}
+
+var pinFailures = struct {
+	mu    sync.Mutex
+	hosts map[string]*PinFailure
+}{hosts: map[string]*PinFailure{}}
+
+// PinFailures returns current pin mismatches sorted by host
+func PinFailures() []PinFailure {
+	pinFailures.mu.Lock()
+	defer pinFailures.mu.Unlock()
+	failures := make([]PinFailure, 0, len(pinFailures.hosts))
+	for _, failure := range pinFailures.hosts {
+		failures = append(failures, *failure)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Host < failures[j].Host
+	})
+	return failures
+}
+
+func recordPinResult(host string, err error) {
+	pinFailures.mu.Lock()
+	defer pinFailures.mu.Unlock()
+	if err == nil {
+		delete(pinFailures.hosts, host)
+		return
+	}
+	failure, ok := pinFailures.hosts[host]
+	if !ok {
+		failure = &PinFailure{Host: host}
+		pinFailures.hosts[host] = failure
+	}
+	failure.Error = err.Error()
+	failure.At = time.Now()
+	failure.Count++
+}
+
+// SPKIPin returns the pin of the certificate key in the form used in the config
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func validatePins(pins []config.CertPinConfig) error {
+	for _, pin := range pins {
+		if _, err := path.Match(pin.Host, ""); err != nil {
+			return fmt.Errorf("invalid pinned host pattern %q: %w", pin.Host, err)
+		}
+		if len(pin.Sha256) == 0 {
+			return fmt.Errorf("no pins for host pattern %q", pin.Host)
+		}
+		for _, hash := range pin.Sha256 {
+			if raw, err := base64.StdEncoding.DecodeString(hash); err != nil || len(raw) != sha256.Size {
+				return fmt.Errorf("invalid pin %q for host pattern %q: expected base64 SHA-256", hash, pin.Host)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyPins returns a tls.Config.VerifyConnection callback checking the chain against the pins of the host
+func verifyPins(pins []config.CertPinConfig) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		host := strings.ToLower(cs.ServerName)
+		i := slices.IndexFunc(pins, func(pin config.CertPinConfig) bool {
+			ok, _ := path.Match(strings.ToLower(pin.Host), host)
+			return ok
+		})
+		if i < 0 {
+			return nil
+		}
+
+		chains := cs.VerifiedChains
+		if len(chains) == 0 {
+			chains = [][]*x509.Certificate{cs.PeerCertificates}
+		}
+		got := []string{}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				pin := SPKIPin(cert)
+				if slices.Contains(pins[i].Sha256, pin) {
+					recordPinResult(host, nil)
+					return nil
+				}
+				if !slices.Contains(got, pin) {
+					got = append(got, pin)
+				}
+			}
+		}
+		err := &PinMismatchError{Host: host, Got: got}
+		recordPinResult(host, err)
+		log.Error().Str("host", host).Strs("chain_pins", got).Msg("Certificate pin mismatch, refusing the connection")
+		return err
+	}
+}
@@ -0,0 +1,198 @@
+package outbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// TLSConfig returns the TLS config for connections to the hive and the cloud proxies:
+// system roots plus the configured CA, public key pins and the client certificate if they are configured
+func TLSConfig(sslCfg config.SSLConfigSection) (*tls.Config, error) {
+	certPool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	if sslCfg.Ca != "" {
+		caCert, err := os.ReadFile(sslCfg.Ca)
+		if err != nil {
+			return nil, err
+		}
+		certPool.AppendCertsFromPEM(caCert)
+	}
+	tlsConfig := &tls.Config{
+		RootCAs: certPool,
+	}
+	if len(sslCfg.Pins) > 0 {
+		if err := validatePins(sslCfg.Pins); err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyConnection = verifyPins(sslCfg.Pins)
+	}
+
+	if sslCfg.Cert == "" && sslCfg.Key == "" {
+		return tlsConfig, nil
+	}
+	if sslCfg.Cert == "" || sslCfg.Key == "" {
+		return nil, errors.New("both ssl cert and key must be set for a client certificate")
+	}
+	cert := getClientCertificate(sslCfg.Cert, sslCfg.Key)
+	if _, err := cert.load(); err != nil {
+		return nil, err
+	}
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return cert.load()
+	}
+	return tlsConfig, nil
+}
+
+// ForHost returns a copy of the TLS config for a connection to host.
+// tls.ConnectionState has no server name for IP addresses, so the host is passed to the pin check explicitly.
+func ForHost(tlsConfig *tls.Config, host string) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	if verify := tlsConfig.VerifyConnection; verify != nil {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			cs.ServerName = host
+			return verify(cs)
+		}
+	}
+	return tlsConfig
+}
+
+var currentClientCert struct {
+	mu   sync.Mutex
+	cert *clientCertificate
+}
+
+// getClientCertificate returns the same certificate while the config values stay the same, so changes of the files are tracked
+func getClientCertificate(certValue string, keyValue string) *clientCertificate {
+	currentClientCert.mu.Lock()
+	defer currentClientCert.mu.Unlock()
+	if c := currentClientCert.cert; c != nil && c.cert.value == certValue && c.key.value == keyValue {
+		return c
+	}
+	currentClientCert.cert = &clientCertificate{
+		cert: pemSource{value: certValue},
+		key:  pemSource{value: keyValue},
+	}
+	return currentClientCert.cert
+}
+
+// clientCertificate is reloaded on a handshake after its files change
+type clientCertificate struct {
+	mu     sync.Mutex
+	cert   pemSource
+	key    pemSource
+	loaded *tls.Certificate
+}
+
+func (c *clientCertificate) load() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	certChanged, err := c.cert.changed()
+	if err != nil {
+		return c.keepLoaded(err)
+	}
+	keyChanged, err := c.key.changed()
+	if err != nil {
+		return c.keepLoaded(err)
+	}
+	if c.loaded != nil && !certChanged && !keyChanged {
+		return c.loaded, nil
+	}
+
+	certPEM, certStat, err := c.cert.read()
+	if err != nil {
+		return c.keepLoaded(err)
+	}
+	keyPEM, keyStat, err := c.key.read()
+	if err != nil {
+		return c.keepLoaded(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return c.keepLoaded(fmt.Errorf("invalid client certificate: %w", err))
+	}
+	// Remembered only after success, so a half-replaced pair is retried on the next handshake
+	c.cert.remember(certStat)
+	c.key.remember(keyStat)
+	if c.loaded != nil {
+		log.Info().Msg("Client certificate reloaded")
+	}
+	c.loaded = &cert
+	return c.loaded, nil
+}
+
+// keepLoaded returns the previous certificate if there is one, because files may be in the middle of replacement
+func (c *clientCertificate) keepLoaded(err error) (*tls.Certificate, error) {
+	if c.loaded == nil {
+		return nil, err
+	}
+	log.Warn().Err(err).Msg("Unable to reload client certificate, using the previous one")
+	return c.loaded, nil
+}
+
+// pemSource is a cert or key config value: a file path, file:path, env:VAR or plain:PEM
+type pemSource struct {
+	value   string
+	modTime time.Time
+	size    int64
+}
+
+func (s *pemSource) path() string {
+	if path, ok := strings.CutPrefix(s.value, "file:"); ok {
+		return path
+	}
+	if strings.HasPrefix(s.value, "env:") || strings.HasPrefix(s.value, "plain:") {
+		return ""
+	}
+	return s.value
+}
+
+// changed reports whether the file differs from the one read last time. Values not from files never change
+func (s *pemSource) changed() (bool, error) {
+	path := s.path()
+	if path == "" {
+		return false, nil
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return !stat.ModTime().Equal(s.modTime) || stat.Size() != s.size, nil
+}
+
+func (s *pemSource) read() ([]byte, os.FileInfo, error) {
+	path := s.path()
+	if path == "" {
+		value, err := config.LoadFieldValue(s.value)
+		return []byte(value), nil, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, stat, nil
+}
+
+func (s *pemSource) remember(stat os.FileInfo) {
+	if stat != nil {
+		s.modTime = stat.ModTime()
+		s.size = stat.Size()
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// TunnelLimiter caps the number of concurrent tunnels and the rate of new ones
+type TunnelLimiter struct {
+	maxActive int64         // 0 means unlimited
+	newRate   *rate.Limiter // nil means unlimited
+
+	active              atomic.Int64
+	rejectedTooMany     atomic.Uint64
+	rejectedRateLimited atomic.Uint64
+}
+
+func NewTunnelLimiter(maxActive int, newPerSecond float64, newBurst int) *TunnelLimiter {
+	l := &TunnelLimiter{maxActive: int64(max(maxActive, 0))}
+	if newPerSecond > 0 {
+		l.newRate = rate.NewLimiter(rate.Limit(newPerSecond), max(newBurst, 1))
+	}
+	return l
+}
+
+// acquire reserves a slot for a new tunnel. Each successful call must be paired with release
+func (l *TunnelLimiter) acquire() *TunnelError {
+	if l.newRate != nil && !l.newRate.Allow() {
+		l.rejectedRateLimited.Add(1)
+		return newTunnelError(TunnelErrorRateLimited, fmt.Errorf("too many new tunnels per second"))
+	}
+	if active := l.active.Add(1); l.maxActive > 0 && active > l.maxActive {
+		l.active.Add(-1)
+		l.rejectedTooMany.Add(1)
+		return newTunnelError(TunnelErrorTooManyTunnels, fmt.Errorf("limit of %d concurrent tunnels reached", l.maxActive))
+	}
+	return nil
+}
+
+func (l *TunnelLimiter) release() {
+	l.active.Add(-1)
+}
+
+func (l *TunnelLimiter) Active() int64 {
+	return l.active.Load()
+}
+
+func (l *TunnelLimiter) MaxActive() int64 {
+	return l.maxActive
+}
+
+func (l *TunnelLimiter) RejectedTooMany() uint64 {
+	return l.rejectedTooMany.Load()
+}
+
+func (l *TunnelLimiter) RejectedRateLimited() uint64 {
+	return l.rejectedRateLimited.Load()
+}
+
+// admitTunnel acquires slots from all limiters in order. On failure already acquired slots are released
+func admitTunnel(limiters ...*TunnelLimiter) (release func(), tunnelErr *TunnelError) {
+	for i, limiter := range limiters {
+		if tunnelErr := limiter.acquire(); tunnelErr != nil {
+			for _, acquired := range limiters[:i] {
+				acquired.release()
+			}
+			return nil, tunnelErr
+		}
+	}
+	return func() {
+		for _, limiter := range limiters {
+			limiter.release()
+		}
+	}, nil
+}
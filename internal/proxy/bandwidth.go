@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// A limiter is reported as throttling if it delayed traffic within this window
+	throttledStateWindow = 1 * time.Second
+	minBandwidthBurst    = 8192
+)
+
+// BandwidthLimiter is a token bucket limiting a single traffic direction
+type BandwidthLimiter struct {
+	limit   int64 // bytes per second, 0 means unlimited
+	limiter *rate.Limiter
+
+	throttledTotal atomic.Int64 // nanoseconds spent waiting for tokens
+	lastThrottled  atomic.Int64 // unix nanoseconds
+}
+
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	l := &BandwidthLimiter{limit: max(bytesPerSecond, 0)}
+	if l.limit > 0 {
+		l.limiter = rate.NewLimiter(rate.Limit(l.limit), int(max(l.limit, minBandwidthBurst)))
+	}
+	return l
+}
+
+// wait blocks until n bytes may pass through the limiter
+func (l *BandwidthLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || l.limiter == nil {
+		return nil
+	}
+	burst := l.limiter.Burst()
+	for n > 0 {
+		chunk := min(n, burst)
+		n -= chunk
+		reservation := l.limiter.ReserveN(time.Now(), chunk)
+		delay := reservation.Delay()
+		if delay <= 0 {
+			continue
+		}
+		l.throttledTotal.Add(int64(delay))
+		l.lastThrottled.Store(time.Now().UnixNano())
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			reservation.Cancel()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+func (l *BandwidthLimiter) Limit() int64 {
+	return l.limit
+}
+
+// IsThrottling reports whether the limiter delayed traffic recently
+func (l *BandwidthLimiter) IsThrottling() bool {
+	return l.limiter != nil && time.Since(time.Unix(0, l.lastThrottled.Load())) < throttledStateWindow
+}
+
+// ThrottledTotal returns the total time traffic was delayed by the limiter
+func (l *BandwidthLimiter) ThrottledTotal() time.Duration {
+	return time.Duration(l.throttledTotal.Load())
+}
+
+// BandwidthShaper limits both traffic directions of a tunnel, a proxy connection or the whole agent
+type BandwidthShaper struct {
+	Upload   *BandwidthLimiter // inner -> proxy
+	Download *BandwidthLimiter // proxy -> inner
+}
+
+func NewBandwidthShaper(limits config.BandwidthLimits) *BandwidthShaper {
+	return &BandwidthShaper{
+		Upload:   NewBandwidthLimiter(limits.Upload),
+		Download: NewBandwidthLimiter(limits.Download),
+	}
+}
+
+// waitUpload waits for every shaper in the chain to let n bytes go from the inner socket to the proxy
+func waitUpload(ctx context.Context, n int, shapers ...*BandwidthShaper) error {
+	for _, shaper := range shapers {
+		if err := shaper.Upload.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitDownload waits for every shaper in the chain to let n bytes go from the proxy to the inner socket
+func waitDownload(ctx context.Context, n int, shapers ...*BandwidthShaper) error {
+	for _, shaper := range shapers {
+		if err := shaper.Download.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+type ConnectionState int
+
+const (
+	ConnectionStateConnecting ConnectionState = iota
+	ConnectionStateConnected
+	ConnectionStateBackoff
+	ConnectionStateDraining
+	ConnectionStateClosing
+	ConnectionStateClosed
+)
+
+var connectionStateEnumToString = map[ConnectionState]string{
+	ConnectionStateConnecting: "connecting",
+	ConnectionStateConnected:  "connected",
+	ConnectionStateBackoff:    "backoff",
+	ConnectionStateDraining:   "draining",
+	ConnectionStateClosing:    "closing",
+	ConnectionStateClosed:     "closed",
+}
+
+func (e ConnectionState) String() string {
+	if s, ok := connectionStateEnumToString[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int(e))
+}
+
+// ConnectionStatus is a snapshot of the proxy connection state
+type ConnectionStatus struct {
+	State ConnectionState
+	// Connection attempts since the last successful connection
+	Attempts int
+	// The error of the last failed attempt or of the lost connection
+	LastError error
+	// Zero if not connected
+	ConnectedSince time.Time
+	// Zero if not in backoff
+	NextRetryAt time.Time
+	// Zero if not draining
+	DrainStartedAt time.Time
+	// Also zero if the tunnels may take however long they need
+	DrainDeadline time.Time
+}
+
+// canTransit reports whether the state machine allows switching from one state to another.
+// Draining, closing and closed states are terminal for the reconnect loop.
+func (e ConnectionState) canTransit(to ConnectionState) bool {
+	switch e {
+	case ConnectionStateDraining:
+		return to == ConnectionStateClosing || to == ConnectionStateClosed
+	case ConnectionStateClosing:
+		return to == ConnectionStateClosed
+	case ConnectionStateClosed:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// xrpc Dial takes neither an HTTP client nor a dialer, so it can't go through the outbound proxy by itself.
+// Such connections are made through a one-shot relay on the loopback interface: xrpc sends the websocket handshake
+// to the relay over plain HTTP, and the relay forwards it to the endpoint using the outbound dialer and TLS of the agent.
+// The handshake must carry the one-time token of the relay, so other local processes can't reach the proxy
+// with the credentials of the agent through it.
+
+// Sent by xrpc as an HTTP header of the handshake
+const relayTokenMetadata = "x-kvmd-cloud-relay"
+
+const relayHandshakeTimeout = 10 * time.Second
+
+type dialRelay struct {
+	listener net.Listener
+	token    string
+	// Host of the endpoint for the forwarded handshake
+	host string
+	dial func(ctx context.Context) (net.Conn, error)
+
+	mu  sync.Mutex
+	err error
+}
+
+// startDialRelay listens on a random loopback port until the relay is closed or a handshake has been forwarded
+func startDialRelay(ctx context.Context, host string, dial func(ctx context.Context) (net.Conn, error)) (*dialRelay, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, 32)
+	rand.Read(token)
+	r := &dialRelay{
+		listener: listener,
+		token:    hex.EncodeToString(token),
+		host:     host,
+		dial:     dial,
+	}
+	go r.serve(ctx)
+	return r, nil
+}
+
+// Addr returns host:port of the relay for xrpc Dial
+func (r *dialRelay) Addr() string {
+	return r.listener.Addr().String()
+}
+
+// WithToken adds the token of the relay to the metadata xrpc sends in the handshake
+func (r *dialRelay) WithToken(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, relayTokenMetadata, r.token)
+}
+
+// Err returns the error of the connection to the endpoint, which xrpc only sees as a failed handshake
+func (r *dialRelay) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close stops accepting connections. The forwarded one is kept until either side closes it
+func (r *dialRelay) Close() {
+	r.listener.Close()
+}
+
+func (r *dialRelay) serve(ctx context.Context) {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		if r.forward(ctx, conn) {
+			r.listener.Close()
+			return
+		}
+	}
+}
+
+// forward relays the connection to the endpoint if it starts with the handshake carrying the token
+func (r *dialRelay) forward(ctx context.Context, conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(relayHandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil || subtle.ConstantTimeCompare([]byte(req.Header.Get(relayTokenMetadata)), []byte(r.token)) != 1 {
+		conn.Close()
+		return false
+	}
+	conn.SetReadDeadline(time.Time{})
+	req.Header.Del(relayTokenMetadata)
+	req.Host = r.host
+
+	upstream, err := r.dial(ctx)
+	if err == nil {
+		if err = req.Write(upstream); err != nil {
+			upstream.Close()
+		}
+	}
+	if err != nil {
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		conn.Close()
+		return true
+	}
+
+	go func() {
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(upstream, reader)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(conn, upstream)
+			done <- struct{}{}
+		}()
+		<-done
+		conn.Close()
+		upstream.Close()
+	}()
+	return true
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func startTestRelay(t *testing.T) (*dialRelay, <-chan *http.Request) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { upstream.Close() })
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+	}()
+
+	relay, err := startDialRelay(context.Background(), "proxy.example:443", func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", upstream.Addr().String())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(relay.Close)
+	return relay, requests
+}
+
+func sendRelayRequest(t *testing.T, relay *dialRelay, token string) net.Conn {
+	conn, err := net.Dial("tcp", relay.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req, _ := http.NewRequest(http.MethodGet, "http://"+relay.Addr()+"/rpc", http.NoBody)
+	if token != "" {
+		req.Header.Set(relayTokenMetadata, token)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestDialRelayRejectsWithoutToken(t *testing.T) {
+	relay, requests := startTestRelay(t)
+
+	conn := sendRelayRequest(t, relay, "wrong")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want the connection closed by the relay", err)
+	}
+	select {
+	case <-requests:
+		t.Fatal("request without the token was forwarded")
+	default:
+	}
+}
+
+func TestDialRelayForwardsHandshake(t *testing.T) {
+	relay, requests := startTestRelay(t)
+
+	sendRelayRequest(t, relay, "")
+	sendRelayRequest(t, relay, relay.token)
+	select {
+	case req := <-requests:
+		if req.Host != "proxy.example:443" {
+			t.Errorf("got host %q, want the endpoint host", req.Host)
+		}
+		if req.URL.Path != "/rpc" {
+			t.Errorf("got path %q, want /rpc", req.URL.Path)
+		}
+		if req.Header.Get(relayTokenMetadata) != "" {
+			t.Error("the token was forwarded to the endpoint")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request with the token was not forwarded")
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+)
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+var circuitStateEnumToString = map[CircuitState]string{
+	CircuitClosed:   "closed",
+	CircuitOpen:     "open",
+	CircuitHalfOpen: "half-open",
+}
+
+func (e CircuitState) String() string {
+	if s, ok := circuitStateEnumToString[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int(e))
+}
+
+// rttSmoothing is the weight of a new RTT sample in the moving average
+const rttSmoothing = 0.2
+
+// EndpointHealth scores a proxy endpoint by connect failures, session drops and RTT.
+// It outlives proxy connections, so the history is kept when the endpoint is reconnected.
+type EndpointHealth struct {
+	Endpoint string
+
+	mu                  sync.Mutex
+	cfg                 config.CircuitBreakerConfigSection
+	consecutiveFailures int
+	drops               []time.Time
+	rtt                 time.Duration // 0 if unknown
+	circuit             CircuitState
+	openUntil           time.Time
+	tripper             func(h *EndpointHealth)
+}
+
+// EndpointHealthStatus is a snapshot of the endpoint health
+type EndpointHealthStatus struct {
+	Score               int
+	Circuit             CircuitState
+	ConsecutiveFailures int
+	RecentDrops         int
+	Rtt                 time.Duration
+	// Zero unless the circuit is open
+	OpenUntil time.Time
+}
+
+// newEndpointHealth creates the health tracker. When the thresholds are reached, tripper decides whether
+// to open the circuit and is called without locks held. Without tripper the circuit opens right away
+func newEndpointHealth(endpoint string, cfg config.CircuitBreakerConfigSection, tripper func(h *EndpointHealth)) *EndpointHealth {
+	return &EndpointHealth{
+		Endpoint: endpoint,
+		cfg:      cfg,
+		tripper:  tripper,
+	}
+}
+
+func (h *EndpointHealth) recordConnectFailure() {
+	h.mu.Lock()
+	h.consecutiveFailures++
+	trip := h.circuit == CircuitHalfOpen ||
+		(h.cfg.FailureThreshold > 0 && h.consecutiveFailures >= h.cfg.FailureThreshold)
+	h.mu.Unlock()
+	if trip {
+		h.trip()
+	}
+}
+
+func (h *EndpointHealth) recordConnected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.consecutiveFailures = 0
+	if h.circuit == CircuitHalfOpen {
+		h.circuit = CircuitClosed
+		h.drops = nil
+	}
+}
+
+// recordSessionDrop registers an established connection lost unexpectedly
+func (h *EndpointHealth) recordSessionDrop() {
+	h.mu.Lock()
+	now := time.Now()
+	h.drops = append(h.drops, now)
+	h.pruneDrops(now)
+	trip := h.cfg.DropThreshold > 0 && len(h.drops) >= h.cfg.DropThreshold
+	h.mu.Unlock()
+	if trip {
+		h.trip()
+	}
+}
+
+func (h *EndpointHealth) recordRTT(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rtt == 0 {
+		h.rtt = rtt
+	} else {
+		h.rtt = time.Duration(rttSmoothing*float64(rtt) + (1-rttSmoothing)*float64(h.rtt))
+	}
+}
+
+func (h *EndpointHealth) trip() {
+	if h.tripper != nil {
+		h.tripper(h)
+		return
+	}
+	h.open()
+}
+
+// open opens the circuit for the cooldown. Returns false if it is already open
+func (h *EndpointHealth) open() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.circuit == CircuitOpen {
+		return false
+	}
+	h.circuit = CircuitOpen
+	h.openUntil = time.Now().Add(h.cfg.Cooldown)
+	return true
+}
+
+// allowConnect reports whether the endpoint may be connected. An open circuit turns half-open after the cooldown
+func (h *EndpointHealth) allowConnect() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.updateCircuit(time.Now())
+	return h.circuit != CircuitOpen
+}
+
+// IsBroken reports whether the circuit of the endpoint is open
+func (h *EndpointHealth) IsBroken() bool {
+	return h.Status().Circuit == CircuitOpen
+}
+
+func (h *EndpointHealth) Status() EndpointHealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.updateCircuit(now)
+	h.pruneDrops(now)
+	status := EndpointHealthStatus{
+		Score:               h.score(),
+		Circuit:             h.circuit,
+		ConsecutiveFailures: h.consecutiveFailures,
+		RecentDrops:         len(h.drops),
+		Rtt:                 h.rtt,
+	}
+	if h.circuit == CircuitOpen {
+		status.OpenUntil = h.openUntil
+	}
+	return status
+}
+
+// score returns the health from 0 to 100. Must be called with h.mu held
+func (h *EndpointHealth) score() int {
+	if h.circuit == CircuitOpen {
+		return 0
+	}
+	score := 100
+	score -= min(h.consecutiveFailures*15, 60)
+	score -= min(len(h.drops)*10, 30)
+	// 2 points per every 100ms of RTT
+	score -= min(int(h.rtt/(100*time.Millisecond))*2, 20)
+	return max(score, 0)
+}
+
+func (h *EndpointHealth) updateCircuit(now time.Time) {
+	if h.circuit == CircuitOpen && !now.Before(h.openUntil) {
+		h.circuit = CircuitHalfOpen
+		h.consecutiveFailures = 0
+	}
+}
+
+func (h *EndpointHealth) pruneDrops(now time.Time) {
+	i := 0
+	for i < len(h.drops) && now.Sub(h.drops[i]) > h.cfg.DropWindow {
+		i++
+	}
+	h.drops = h.drops[i:]
+}
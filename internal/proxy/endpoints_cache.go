@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+)
+
+// endpointsCache is the last endpoint list received from the hive
+type endpointsCache struct {
+	Endpoints []string  `json:"endpoints"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// loadCachedEndpoints returns cached endpoints if the cache exists and is not too old
+func loadCachedEndpoints(cfg config.EndpointsCacheConfigSection) ([]string, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	cache, err := readEndpointsCache(cfg.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if age := time.Since(cache.UpdatedAt); cfg.MaxAge > 0 && age > cfg.MaxAge {
+		return nil, fmt.Errorf("endpoints cache is too old: %s", age.Truncate(time.Second))
+	}
+	return cache.Endpoints, nil
+}
+
+// saveCachedEndpoints replaces the cache. The same endpoints are rewritten only when the cache is halfway to MaxAge,
+// the hive is asked every few minutes
+func saveCachedEndpoints(cfg config.EndpointsCacheConfigSection, endpoints []string) error {
+	if cfg.File == "" {
+		return nil
+	}
+	if cache, err := readEndpointsCache(cfg.File); err == nil && slices.Equal(cache.Endpoints, endpoints) &&
+		(cfg.MaxAge <= 0 || time.Since(cache.UpdatedAt) < cfg.MaxAge/2) {
+		return nil
+	}
+	data, err := json.Marshal(endpointsCache{Endpoints: endpoints, UpdatedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.File), 0750); err != nil {
+		return err
+	}
+	return config.WriteFileAtomic(cfg.File, data, 0600)
+}
+
+func readEndpointsCache(path string) (endpointsCache, error) {
+	cache := endpointsCache{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cache, err
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return cache, fmt.Errorf("malformed endpoints cache: %w", err)
+	}
+	return cache, nil
+}
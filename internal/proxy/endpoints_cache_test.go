@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+)
+
+func TestSaveCachedEndpointsSkipsUnchanged(t *testing.T) {
+	cfg := config.EndpointsCacheConfigSection{
+		File:   filepath.Join(t.TempDir(), "endpoints.json"),
+		MaxAge: time.Hour,
+	}
+	endpoints := []string{"a:443", "b:443"}
+	if err := saveCachedEndpoints(cfg, endpoints); err != nil {
+		t.Fatal(err)
+	}
+	first, err := readEndpointsCache(cfg.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := saveCachedEndpoints(cfg, endpoints); err != nil {
+		t.Fatal(err)
+	}
+	if cache, _ := readEndpointsCache(cfg.File); !cache.UpdatedAt.Equal(first.UpdatedAt) {
+		t.Error("unchanged endpoints were rewritten")
+	}
+
+	changed := []string{"b:443", "c:443"}
+	if err := saveCachedEndpoints(cfg, changed); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := loadCachedEndpoints(cfg)
+	if err != nil || !slices.Equal(cached, changed) {
+		t.Errorf("got %v, %v, want the changed endpoints", cached, err)
+	}
+}
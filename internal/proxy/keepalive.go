@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	common_pb "github.com/pikvm/cloud-api/proto/common"
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/xornet-sl/go-xrpc/xrpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// ProbeStats accumulates results of keepalive probes of a proxy connection
+type ProbeStats struct {
+	mu     sync.Mutex
+	status ProbeStatus
+}
+
+type ProbeStatus struct {
+	// Zero until the first successful probe
+	Rtt time.Duration
+	// Mean deviation of RTT between consecutive probes, as in RFC 3550
+	Jitter time.Duration
+	// Probes without a reply in a row
+	Misses      int
+	TotalMisses uint64
+	LastProbeAt time.Time
+}
+
+func (s *ProbeStats) Status() ProbeStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *ProbeStats) recordReply(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.Rtt != 0 {
+		s.status.Jitter += (max(rtt-s.status.Rtt, s.status.Rtt-rtt) - s.status.Jitter) / 16
+	}
+	s.status.Rtt = rtt
+	s.status.Misses = 0
+	s.status.LastProbeAt = time.Now()
+}
+
+// recordMiss returns the number of misses in a row
+func (s *ProbeStats) recordMiss() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Misses++
+	s.status.TotalMisses++
+	s.status.LastProbeAt = time.Now()
+	return s.status.Misses
+}
+
+// resetMisses starts counting misses over for a new connection
+func (s *ProbeStats) resetMisses() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Misses = 0
+}
+
+// keepalive probes the proxy until the connection is closed.
+// The connection is closed when the proxy misses too many probes in a row.
+// Proxies without common.Ping never reply, so misses are counted only after the first reply on the connection,
+// and probing stops if the first MissThreshold probes are left without a reply.
+func (this *ProxyConnection) keepalive(conn *xrpc.RpcConn, cfg config.KeepaliveConfigSection) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	this.probes.resetMisses()
+	replied := false
+	unanswered := 0
+	pinger := common_pb.NewPingClient(conn)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		probeCtx, cancel := context.WithTimeout(conn.Context(), cfg.Timeout)
+		startedAt := time.Now()
+		_, err := pinger.Ping(probeCtx, &emptypb.Empty{})
+		rtt := time.Since(startedAt)
+		timedOut := probeCtx.Err() != nil
+		cancel()
+		if conn.Context().Err() != nil {
+			return
+		}
+
+		// An error reply still means the proxy is reachable
+		if err == nil || !timedOut {
+			this.probes.recordReply(rtt)
+			this.health.recordRTT(rtt)
+			replied = true
+			continue
+		}
+		if !replied {
+			unanswered++
+			if unanswered >= max(cfg.MissThreshold, 1) {
+				this.logger.Info().Int("probes", unanswered).Msg("proxy doesn't reply to keepalive probes, it probably doesn't support them")
+				return
+			}
+			continue
+		}
+		misses := this.probes.recordMiss()
+		this.logger.Debug().Int("misses", misses).Msg("keepalive probe missed")
+		if cfg.MissThreshold > 0 && misses >= cfg.MissThreshold {
+			this.logger.Warn().Int("misses", misses).Msg("proxy doesn't reply to keepalive probes, dropping the connection")
+			conn.Close()
+			return
+		}
+	}
+}
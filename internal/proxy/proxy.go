@@ -3,58 +3,199 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"math/rand"
-	"os"
-	"sync/atomic"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	proxyagent_pb "github.com/pikvm/cloud-api/proto/proxyagent"
 	"github.com/pikvm/kvmd-cloud/internal/config"
 	"github.com/pikvm/kvmd-cloud/internal/config/vars"
+	"github.com/pikvm/kvmd-cloud/internal/outbound"
 	"github.com/rs/zerolog"
 	"github.com/xornet-sl/go-xrpc/xrpc"
 	"google.golang.org/grpc/metadata"
 )
 
 type ProxyConnection struct {
-	Addr   string
-	rpc    atomic.Value // *xrpc.RpcConn
-	cancel context.CancelFunc
+	Addr    string
+	cancel  context.CancelFunc
+	tunnels *TunnelRegistry
+	logger  zerolog.Logger
+	health  *EndpointHealth
+	probes  ProbeStats
+
+	mu     sync.RWMutex
+	rpc    *xrpc.RpcConn // nil unless connected
+	status ConnectionStatus
+
+	// Closed when the connection is established for the first time
+	connected     chan struct{}
+	connectedOnce sync.Once
+	// Closed when the connection is closed for good
+	done chan struct{}
+
+	globalBandwidth *BandwidthShaper
+	bandwidth       *BandwidthShaper
+	globalAdmission *TunnelLimiter
+	admission       *TunnelLimiter
 }
 
+// GetRpcConn returns the current rpc connection or nil if the proxy is not connected
 func (this *ProxyConnection) GetRpcConn() *xrpc.RpcConn {
-	return this.rpc.Load().(*xrpc.RpcConn)
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.rpc
 }
 
 func (this *ProxyConnection) IsReady() bool {
 	return this.GetRpcConn() != nil
 }
 
+// Status returns a snapshot of the connection state
+func (this *ProxyConnection) Status() ConnectionStatus {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.status
+}
+
+// transit switches the state machine to the given state. It returns false if the transition is not allowed
+func (this *ProxyConnection) transit(to ConnectionState, update func(status *ConnectionStatus)) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !this.status.State.canTransit(to) {
+		return false
+	}
+	this.status.State = to
+	// Draining connection keeps serving its tunnels
+	if to != ConnectionStateConnected && to != ConnectionStateDraining {
+		this.rpc = nil
+		this.status.ConnectedSince = time.Time{}
+	}
+	if to != ConnectionStateBackoff {
+		this.status.NextRetryAt = time.Time{}
+	}
+	if update != nil {
+		update(&this.status)
+	}
+	return true
+}
+
+func (this *ProxyConnection) setConnecting() bool {
+	return this.transit(ConnectionStateConnecting, func(status *ConnectionStatus) {
+		status.Attempts++
+	})
+}
+
+func (this *ProxyConnection) setConnected(conn *xrpc.RpcConn) bool {
+	return this.transit(ConnectionStateConnected, func(status *ConnectionStatus) {
+		this.rpc = conn
+		status.Attempts = 0
+		status.LastError = nil
+		status.ConnectedSince = time.Now()
+	})
+}
+
+func (this *ProxyConnection) setBackoff(err error, retryInterval time.Duration) bool {
+	return this.transit(ConnectionStateBackoff, func(status *ConnectionStatus) {
+		if err != nil {
+			status.LastError = err
+		}
+		status.NextRetryAt = time.Now().Add(retryInterval)
+	})
+}
+
+// Health returns the health tracker of the proxy endpoint
+func (this *ProxyConnection) Health() *EndpointHealth {
+	return this.health
+}
+
+// Probes returns results of keepalive probes
+func (this *ProxyConnection) Probes() ProbeStatus {
+	return this.probes.Status()
+}
+
+// Tunnels returns the registry of active tunnels served over this connection
+func (this *ProxyConnection) Tunnels() *TunnelRegistry {
+	return this.tunnels
+}
+
+// Bandwidth returns the bandwidth shaper shared by all tunnels of this connection
+func (this *ProxyConnection) Bandwidth() *BandwidthShaper {
+	return this.bandwidth
+}
+
+// Admission returns the tunnel limiter of this connection
+func (this *ProxyConnection) Admission() *TunnelLimiter {
+	return this.admission
+}
+
 func (this *ProxyConnection) Close() {
+	this.transit(ConnectionStateClosing, nil)
 	this.cancel()
 }
 
-func loadTLSCredentials() (*tls.Config, error) {
-	certPool, err := x509.SystemCertPool()
-	if err != nil {
-		return nil, err
+// IsDraining reports whether the connection has stopped accepting new tunnels
+func (this *ProxyConnection) IsDraining() bool {
+	return this.Status().State == ConnectionStateDraining
+}
+
+// Drain stops accepting new tunnels and waits for the active ones to finish.
+// Tunnels still alive when ctx is done are killed. The connection is closed in the end.
+func (this *ProxyConnection) Drain(ctx context.Context) {
+	now := time.Now()
+	deadline, _ := ctx.Deadline()
+	draining := this.transit(ConnectionStateDraining, func(status *ConnectionStatus) {
+		status.DrainStartedAt = now
+		status.DrainDeadline = deadline
+	})
+	defer this.Close()
+	if !draining {
+		return
 	}
-	if config.Cfg.SSL.Ca != "" {
-		caCert, err := os.ReadFile(config.Cfg.SSL.Ca)
-		if err != nil {
-			return nil, err
+
+	// Admission counter also covers tunnels that are still dialing their targets
+	if active := this.admission.Active(); active > 0 {
+		event := this.logger.Info().Int64("tunnels", active)
+		if !deadline.IsZero() {
+			event = event.Dur("timeout", deadline.Sub(now))
 		}
-		certPool.AppendCertsFromPEM(caCert)
+		event.Msg("draining proxy connection")
 	}
-	config := &tls.Config{
-		RootCAs: certPool,
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for this.admission.Active() > 0 {
+		select {
+		case <-ctx.Done():
+			tunnels := this.tunnels.List()
+			for _, tunnel := range tunnels {
+				tunnel.Kill("drain timeout expired")
+			}
+			this.logger.Warn().Int("tunnels", len(tunnels)).Msg("drain timeout expired, remaining tunnels killed")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+const drainPollInterval = 250 * time.Millisecond
+
+// ValidateConfig checks the parts of the config used by proxy connections before it's applied
+func ValidateConfig(cfg *config.Config) error {
+	// The hive may use TLS even without SSL for the proxies
+	if _, err := outbound.TLSConfig(cfg.SSL); err != nil {
+		return fmt.Errorf("unable to load TLS credentials: %w", err)
+	}
+	if _, err := outbound.NewDialer(cfg.OutboundProxy); err != nil {
+		return err
 	}
-	return config, nil
+	return ValidateProxyProtocol(cfg)
 }
 
-func ConnectWithRetry(ctx context.Context, proxyEndpoint string) (*ProxyConnection, error) {
+func ConnectWithRetry(ctx context.Context, proxyEndpoint string, health *EndpointHealth, globalBandwidth *BandwidthShaper, globalAdmission *TunnelLimiter) (*ProxyConnection, error) {
 	logger := zerolog.Ctx(ctx).With().Fields(map[string]any{
 		"component":      "proxy",
 		"proxy_endpoint": proxyEndpoint,
@@ -62,20 +203,45 @@ func ConnectWithRetry(ctx context.Context, proxyEndpoint string) (*ProxyConnecti
 	ctx = logger.WithContext(ctx)
 
 	ctx, cancel := context.WithCancel(ctx)
+	cfg := config.Get()
+
+	if health == nil {
+		health = newEndpointHealth(proxyEndpoint, cfg.Proxy.CircuitBreaker, nil)
+	}
 
 	proxyConnection := &ProxyConnection{
-		Addr:   proxyEndpoint,
-		rpc:    atomic.Value{},
-		cancel: cancel,
+		Addr:    proxyEndpoint,
+		cancel:  cancel,
+		tunnels: NewTunnelRegistry(),
+		logger:  logger,
+		health:  health,
+		status:  ConnectionStatus{State: ConnectionStateConnecting},
+
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+
+		globalBandwidth: globalBandwidth,
+		bandwidth:       NewBandwidthShaper(cfg.Tunnel.Bandwidth.PerProxy),
+		globalAdmission: globalAdmission,
+		admission:       NewTunnelLimiter(cfg.Tunnel.MaxTunnelsPerProxy, 0, 0),
 	}
 
 	onOpen := func(connCtx context.Context, conn *xrpc.RpcConn) (context.Context, error) {
+		if !proxyConnection.setConnected(conn) {
+			return nil, fmt.Errorf("proxy connection is %s", proxyConnection.Status().State)
+		}
+		proxyConnection.connectedOnce.Do(func() { close(proxyConnection.connected) })
 		logger.Info().Msg("connected to proxy")
-		proxyConnection.rpc.Store(conn)
 		return nil, nil
 	}
 
+	// The close error is handed over to the retry loop to be kept as the last error
+	closeErrors := make(chan error, 1)
 	onClosed := func(connCtx context.Context, conn *xrpc.RpcConn, closeError error) {
+		select {
+		case closeErrors <- closeError:
+		default:
+		}
 		if ctx.Err() == nil {
 			logger.Err(closeError).Msg("connection to proxy lost, retrying...")
 		} else {
@@ -90,37 +256,38 @@ func ConnectWithRetry(ctx context.Context, proxyEndpoint string) (*ProxyConnecti
 		xrpc.WithConnClosedCallback(onClosed),
 	}
 
-	if !config.Cfg.NoSSL {
-		tlsConfig, err := loadTLSCredentials()
-		if err != nil {
+	if !cfg.NoSSL {
+		if _, err := outbound.TLSConfig(cfg.SSL); err != nil {
 			return nil, err
 		}
-		opts = append(opts, xrpc.WithTLSConfig(tlsConfig))
 	}
 
-	auth_md := metadata.New(map[string]string{
-		"authorization": "bearer " + config.Cfg.AuthToken,
-		"kind":          "agent",
-		"instance_uuid": vars.InstanceUUID,
-		"version":       vars.VersionString,
-	})
-	ctx = metadata.NewOutgoingContext(ctx, auth_md)
-
 	client := xrpc.NewClient()
 	proxyagent_pb.RegisterAgentForProxyServer(client, &ProxyServer{
 		proxyConnection: proxyConnection,
 	})
 
 	go func() {
-		defer cancel()
-		backoff := 1 * time.Second
-		maxBackoff := 30 * time.Second
-		jitterFactor := 0.25
+		defer func() {
+			cancel()
+			proxyConnection.transit(ConnectionStateClosed, nil)
+			close(proxyConnection.done)
+		}()
+		retry := NewRetryPolicy(cfg.Proxy.Reconnect)
 		for {
-			jitter := time.Duration((rand.Float64() - 0.5) * jitterFactor * float64(backoff))
-			retryInterval := backoff + jitter
-			conn, err := client.Dial(ctx, proxyEndpoint, opts...)
+			if !proxyConnection.setConnecting() {
+				return
+			}
+			// Metadata and TLS config are rebuilt on every attempt to pick up the reloaded config
+			cfg := config.Get()
+			dialCtx := metadata.NewOutgoingContext(ctx, connectionMetadata(cfg))
+			dialStartedAt := time.Now()
+			conn, err := dialProxy(dialCtx, cfg, client, proxyEndpoint, opts)
 			if err == nil {
+				// The handshake takes a few round trips, so it's a rough RTT estimate
+				health.recordRTT(time.Since(dialStartedAt))
+				health.recordConnected()
+				go proxyConnection.keepalive(conn, cfg.Proxy.Keepalive)
 				select {
 				case <-ctx.Done():
 					return
@@ -128,23 +295,120 @@ func ConnectWithRetry(ctx context.Context, proxyEndpoint string) (*ProxyConnecti
 					if ctx.Err() != nil {
 						return
 					}
-					proxyConnection.rpc.Store(nil)
+				}
+				health.recordSessionDrop()
+				retry.ConnectionLost(proxyConnection.Status().ConnectedSince)
+				select {
+				case err = <-closeErrors:
+				default:
+				}
+				if err == nil {
+					err = fmt.Errorf("connection closed")
 				}
 			} else {
+				if ctx.Err() != nil {
+					// Closed while connecting
+					return
+				}
 				logger.Err(err).Msg("failed to connect to proxy, retrying in a few seconds...")
+				health.recordConnectFailure()
 			}
-			select {
-			case <-ctx.Done():
+			retryInterval := retry.NextDelay()
+			if !proxyConnection.setBackoff(err, retryInterval) {
+				// Lost while draining, so there is nothing left to wait for
+				return
+			}
+			if !retry.Wait(ctx, retryInterval) {
 				return
-			case <-time.After(retryInterval):
 			}
-			backoff = min(backoff*2, maxBackoff)
 		}
 	}()
 
 	return proxyConnection, nil
 }
 
+func dialProxy(ctx context.Context, cfg *config.Config, client *xrpc.RpcClient, proxyEndpoint string, opts []xrpc.Option) (*xrpc.RpcConn, error) {
+	dialer, err := outbound.NewDialer(cfg.OutboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	scheme := "http://"
+	if !cfg.NoSSL {
+		if tlsConfig, err = outbound.TLSConfig(cfg.SSL); err != nil {
+			return nil, err
+		}
+		scheme = "https://"
+	}
+	if !strings.HasPrefix(proxyEndpoint, "http://") && !strings.HasPrefix(proxyEndpoint, "https://") {
+		proxyEndpoint = scheme + proxyEndpoint
+	}
+	endpointURL, err := url.Parse(proxyEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy endpoint: %w", err)
+	}
+	addr := endpointURL.Host
+	if endpointURL.Port() == "" {
+		addr = net.JoinHostPort(endpointURL.Hostname(), map[bool]string{true: "443", false: "80"}[tlsConfig != nil])
+	}
+	outboundProxy, err := dialer.ProxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if outboundProxy == nil {
+		if tlsConfig != nil {
+			opts = append(slices.Clip(opts), xrpc.WithTLSConfig(outbound.ForHost(tlsConfig, endpointURL.Hostname())))
+		}
+		return client.Dial(ctx, proxyEndpoint, opts...)
+	}
+
+	relay, err := startDialRelay(ctx, endpointURL.Host, func(ctx context.Context) (net.Conn, error) {
+		if tlsConfig != nil {
+			return dialer.DialTLS(ctx, "tcp", addr, tlsConfig)
+		}
+		return dialer.DialContext(ctx, "tcp", addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer relay.Close()
+	conn, err := client.Dial(relay.WithToken(ctx), "http://"+relay.Addr()+endpointURL.RequestURI(), opts...)
+	if err != nil {
+		if relayErr := relay.Err(); relayErr != nil {
+			return nil, relayErr
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Metadata keys of agent extensions to the proxy protocol. Proxies that don't know them never send them,
+// so the agent keeps the plain behaviour with such proxies
+const (
+	// Half-close capability, announced with "1" by the agent in its connection metadata
+	// and by the proxy in the metadata of every ConnectionChannel stream
+	metadataHalfClose = "half-close"
+	// Address of the cloud client as ip:port, set by the proxy in the metadata of ConnectionChannel streams
+	metadataClientAddr = "client-addr"
+)
+
+func connectionMetadata(cfg *config.Config) metadata.MD {
+	md := metadata.New(map[string]string{
+		"kind":          "agent",
+		"instance_uuid": vars.InstanceUUID,
+		"version":       vars.VersionString,
+		"services":      strings.Join(cfg.EnabledServiceNames(), ","),
+		// Streams use half-close only if the proxy announces it too
+		metadataHalfClose: "1",
+	})
+	// Devices authenticated by a client certificate may have no token
+	if cfg.AuthToken != "" {
+		md.Set("authorization", "bearer "+cfg.AuthToken)
+	}
+	return md
+}
+
 func onLog(logContext *xrpc.LogContext, err error, msg string) {
 	logger := zerolog.Ctx(logContext.RpcConnection.Context()).With().Fields(logContext.Fields).Logger()
 
@@ -156,7 +420,7 @@ func onLog(logContext *xrpc.LogContext, err error, msg string) {
 }
 
 func onDebugLog(fn xrpc.DebugLogGetter) {
-	if config.Cfg.Log.Trace {
+	if config.Get().Log.Trace {
 		logContext, msg := fn()
 		onLog(logContext, nil, fmt.Sprintf("debug: %s", msg))
 	}
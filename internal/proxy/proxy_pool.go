@@ -7,11 +7,14 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/pikvm/cloud-api/api_models"
 	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/pikvm/kvmd-cloud/internal/outbound"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -19,19 +22,52 @@ import (
 type ProxyPool struct {
 	mu          sync.RWMutex
 	connections map[string]*ProxyConnection
-	updateCh    chan struct{}
+	draining    map[*ProxyConnection]struct{}
+	// New connections to the endpoints of current ones, swapped in once they are up
+	replacing map[string]*ProxyConnection
+	// Context of proxy connections, nil until Serve is called
+	connCtx context.Context
+	// Bounds drains waiting for the connections to become idle, cancelled on shutdown
+	idleDrainCtx   context.Context
+	stopIdleDrains context.CancelFunc
+	// Guards health separately, because circuits may trip while p.mu is held
+	healthMu  sync.Mutex
+	health    map[string]*EndpointHealth
+	drainWg   sync.WaitGroup
+	updateCh  chan struct{}
+	bandwidth *BandwidthShaper
+	admission *TunnelLimiter
 }
 
 func NewProxyPool() *ProxyPool {
+	cfg := config.Get()
+	idleDrainCtx, stopIdleDrains := context.WithCancel(context.Background())
 	return &ProxyPool{
-		connections: make(map[string]*ProxyConnection),
-		updateCh:    make(chan struct{}),
+		connections:    make(map[string]*ProxyConnection),
+		draining:       make(map[*ProxyConnection]struct{}),
+		replacing:      make(map[string]*ProxyConnection),
+		idleDrainCtx:   idleDrainCtx,
+		stopIdleDrains: stopIdleDrains,
+		health:         make(map[string]*EndpointHealth),
+		updateCh:       make(chan struct{}, 1),
+		bandwidth:      NewBandwidthShaper(cfg.Tunnel.Bandwidth.Global),
+		admission: NewTunnelLimiter(
+			cfg.Tunnel.MaxTunnels,
+			cfg.Tunnel.NewTunnelsRate,
+			cfg.Tunnel.NewTunnelsBurst,
+		),
 	}
 }
 
 func (p *ProxyPool) Serve(ctx context.Context) {
 	logger := log.Logger
 	ctx = logger.WithContext(ctx)
+	// Connections outlive ctx to drain their tunnels on shutdown
+	connCtx, cancelConns := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelConns()
+	p.mu.Lock()
+	p.connCtx = connCtx
+	p.mu.Unlock()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -52,11 +88,15 @@ func (p *ProxyPool) Serve(ctx context.Context) {
 			case <-time.After(updateInterval):
 			case <-p.updateCh:
 			}
-			endpoints := getAvailableProxiesWithRetry(ctx)
+			endpoints := p.fetchEndpoints(ctx)
 			if endpoints == nil {
 				continue
 			}
-			newEndpointsCh <- endpoints
+			select {
+			case <-ctx.Done():
+				return
+			case newEndpointsCh <- endpoints:
+			}
 		}
 	}()
 
@@ -67,17 +107,341 @@ func (p *ProxyPool) Serve(ctx context.Context) {
 				return
 			case endpoints := <-newEndpointsCh:
 				logger.Info().Strs("endpoints", endpoints).Msg("received proxy endpoints, updating connections")
-				p.updateConnections(ctx, endpoints)
+				cfg := config.Get()
+				if selection := cfg.Proxy.Selection; selection.Mode == config.SelectionModeBest && selection.Count > 0 {
+					endpoints = p.selectBestEndpoints(ctx, cfg, endpoints)
+					logger.Info().Strs("endpoints", endpoints).Msg("selected the fastest proxy endpoints")
+				}
+				p.updateConnections(connCtx, endpoints)
 			}
 		}
 	}()
 
+	// Connect to the last known proxies right away, the hive may be unreachable for a while
+	if endpoints := initialEndpoints(ctx); len(endpoints) > 0 {
+		logger.Info().Strs("endpoints", endpoints).Msg("using static and cached proxy endpoints until the hive replies")
+		select {
+		case <-ctx.Done():
+		case newEndpointsCh <- endpoints:
+		}
+	}
 	p.UpdateEndpoints()
 	<-ctx.Done()
+
+	logger.Info().Msg("draining proxy connections")
+	p.drainAll()
+}
+
+// Tunnels returns active tunnels of all proxy connections sorted by start time
+func (p *ProxyPool) Tunnels() []*Tunnel {
+	tunnels := []*Tunnel{}
+	for _, conn := range p.allConnections() {
+		tunnels = append(tunnels, conn.Tunnels().List()...)
+	}
+	sortTunnels(tunnels)
+	return tunnels
+}
+
+// KillTunnel terminates an active tunnel by cid. Returns false if there is no such tunnel
+func (p *ProxyPool) KillTunnel(cid string, reason string) bool {
+	found := false
+	for _, conn := range p.allConnections() {
+		if tunnel := conn.Tunnels().Get(cid); tunnel != nil {
+			tunnel.Kill(reason)
+			found = true
+		}
+	}
+	return found
+}
+
+// KillAllTunnels terminates all active tunnels and returns their cids
+func (p *ProxyPool) KillAllTunnels(reason string) []string {
+	cids := []string{}
+	for _, tunnel := range p.Tunnels() {
+		tunnel.Kill(reason)
+		cids = append(cids, tunnel.Cid)
+	}
+	return cids
+}
+
+// Bandwidth returns the agent-wide bandwidth shaper
+func (p *ProxyPool) Bandwidth() *BandwidthShaper {
+	return p.bandwidth
+}
+
+// Admission returns the agent-wide tunnel limiter
+func (p *ProxyPool) Admission() *TunnelLimiter {
+	return p.admission
+}
+
+// Connections returns current proxy connections sorted by address
+func (p *ProxyPool) Connections() []*ProxyConnection {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	conns := make([]*ProxyConnection, 0, len(p.connections))
+	for _, conn := range p.connections {
+		conns = append(conns, conn)
+	}
+	sortConnections(conns)
+	return conns
+}
+
+// Health returns health trackers of known endpoints sorted by endpoint
+func (p *ProxyPool) Health() []*EndpointHealth {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	health := make([]*EndpointHealth, 0, len(p.health))
+	for _, h := range p.health {
+		health = append(health, h)
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].Endpoint < health[j].Endpoint
+	})
+	return health
+}
+
+// BrokenEndpoints returns sorted endpoints with the open circuit
+func (p *ProxyPool) BrokenEndpoints() []string {
+	broken := []string{}
+	for _, h := range p.Health() {
+		if h.IsBroken() {
+			broken = append(broken, h.Endpoint)
+		}
+	}
+	return broken
+}
+
+// endpointHealth returns the health tracker of the endpoint creating it if needed
+func (p *ProxyPool) endpointHealth(ctx context.Context, endpoint string) *EndpointHealth {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	if h, ok := p.health[endpoint]; ok {
+		return h
+	}
+	h := newEndpointHealth(endpoint, config.Get().Proxy.CircuitBreaker, func(h *EndpointHealth) {
+		p.tripEndpoint(ctx, h)
+	})
+	p.health[endpoint] = h
+	return h
+}
+
+// tripEndpoint opens the circuit of the endpoint unless fewer than MinHealthyEndpoints other endpoints
+// would be left to connect to. A failing endpoint is still better than none.
+func (p *ProxyPool) tripEndpoint(ctx context.Context, h *EndpointHealth) {
+	logger := zerolog.Ctx(ctx)
+
+	p.healthMu.Lock()
+	candidates := 0
+	for _, other := range p.health {
+		if other != h && !other.IsBroken() {
+			candidates++
+		}
+	}
+	if minHealthy := config.Get().Proxy.MinHealthyEndpoints; candidates < minHealthy {
+		p.healthMu.Unlock()
+		logger.Debug().Str("endpoint", h.Endpoint).Int("candidates", candidates).
+			Msg("proxy endpoint keeps failing, but too few other endpoints are left to open its circuit")
+		return
+	}
+	opened := h.open()
+	p.healthMu.Unlock()
+	if !opened {
+		return
+	}
+
+	// Called from the connection goroutine, so the pool is updated asynchronously
+	go p.breakEndpoint(ctx, h.Endpoint)
+	// Let the endpoint have a trial connection as soon as the cooldown expires
+	time.AfterFunc(h.cfg.Cooldown, p.UpdateEndpoints)
+}
+
+// breakEndpoint removes the connection to the endpoint with the open circuit
+// and requests new endpoints if too few healthy ones are left
+func (p *ProxyPool) breakEndpoint(ctx context.Context, endpoint string) {
+	logger := zerolog.Ctx(ctx)
+
+	p.mu.Lock()
+	if conn, ok := p.connections[endpoint]; ok {
+		p.startDrain(conn)
+		delete(p.connections, endpoint)
+	}
+	if conn, ok := p.replacing[endpoint]; ok {
+		p.startDrain(conn)
+		delete(p.replacing, endpoint)
+	}
+	healthy := 0
+	for _, conn := range p.connections {
+		if !conn.Health().IsBroken() {
+			healthy++
+		}
+	}
+	p.mu.Unlock()
+
+	logger.Warn().Str("endpoint", endpoint).Int("healthy", healthy).Msg("proxy endpoint keeps failing, circuit opened")
+	if healthy < config.Get().Proxy.MinHealthyEndpoints {
+		p.UpdateEndpoints()
+	}
+}
+
+// Draining returns connections removed from the pool which are still draining their tunnels
+func (p *ProxyPool) Draining() []*ProxyConnection {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	conns := make([]*ProxyConnection, 0, len(p.draining))
+	for conn := range p.draining {
+		conns = append(conns, conn)
+	}
+	sortConnections(conns)
+	return conns
+}
+
+// allConnections returns both current and draining connections
+func (p *ProxyPool) allConnections() []*ProxyConnection {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	conns := make([]*ProxyConnection, 0, len(p.connections)+len(p.draining))
+	for _, conn := range p.connections {
+		conns = append(conns, conn)
+	}
+	for conn := range p.draining {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func sortConnections(conns []*ProxyConnection) {
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Addr < conns[j].Addr
+	})
+}
+
+// startDrain moves the connection to the draining set. Tunnels still alive after DrainTimeout are killed.
+// Must be called with p.mu held
+func (p *ProxyPool) startDrain(conn *ProxyConnection) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Get().Tunnel.DrainTimeout)
+	p.drainUntil(conn, ctx, cancel)
+}
+
+// startIdleDrain moves the connection to the draining set and lets its tunnels finish however long they take.
+// On shutdown they get DrainTimeout as usual. Must be called with p.mu held
+func (p *ProxyPool) startIdleDrain(conn *ProxyConnection) {
+	p.drainUntil(conn, p.idleDrainCtx, func() {})
+}
+
+// drainUntil drains the connection in the background until ctx is done and calls cancel then.
+// Must be called with p.mu held
+func (p *ProxyPool) drainUntil(conn *ProxyConnection, ctx context.Context, cancel context.CancelFunc) {
+	p.draining[conn] = struct{}{}
+	p.drainWg.Add(1)
+	go func() {
+		defer p.drainWg.Done()
+		defer cancel()
+		conn.Drain(ctx)
+		p.mu.Lock()
+		delete(p.draining, conn)
+		p.mu.Unlock()
+	}()
+}
+
+// drainConnections moves all current connections to the draining set and drops pending replacements
+func (p *ProxyPool) drainConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ep, conn := range p.connections {
+		p.startDrain(conn)
+		delete(p.connections, ep)
+	}
+	for ep, conn := range p.replacing {
+		p.startDrain(conn)
+		delete(p.replacing, ep)
+	}
+}
+
+// drainAll drains all proxy connections and waits until they are closed
+func (p *ProxyPool) drainAll() {
+	p.drainConnections()
+	stop := time.AfterFunc(config.Get().Tunnel.DrainTimeout, p.stopIdleDrains)
+	defer stop.Stop()
+	p.drainWg.Wait()
+}
+
+// Reconnect establishes new connections to the current endpoints, e.g. after the credentials have changed.
+// Old connections keep serving until their replacements are up, so the hive doesn't have to be reachable.
+func (p *ProxyPool) Reconnect() {
+	for _, conn := range p.Connections() {
+		go p.replaceConnection(conn, p.startDrain)
+	}
+}
+
+// replaceConnection connects to the endpoint of the connection again and swaps the new connection in once it's up.
+// The old connection is handed over to drain then, which is called with p.mu held.
+// A connection that isn't up anyway is replaced right away.
+func (p *ProxyPool) replaceConnection(old *ProxyConnection, drain func(conn *ProxyConnection)) {
+	p.mu.Lock()
+	ctx := p.connCtx
+	if ctx == nil || p.connections[old.Addr] != old {
+		// Not serving yet, or already replaced or removed
+		p.mu.Unlock()
+		return
+	}
+	if pending, ok := p.replacing[old.Addr]; ok {
+		// Superseded, it would announce outdated credentials or services
+		p.startDrain(pending)
+		delete(p.replacing, old.Addr)
+	}
+	conn, err := ConnectWithRetry(ctx, old.Addr, old.Health(), p.bandwidth, p.admission)
+	if err != nil {
+		p.mu.Unlock()
+		zerolog.Ctx(ctx).Err(err).Str("endpoint", old.Addr).Msg("failed to create proxy connection, keeping the old one")
+		return
+	}
+	if old.Status().State != ConnectionStateConnected {
+		p.connections[old.Addr] = conn
+		drain(old)
+		p.mu.Unlock()
+		return
+	}
+	p.replacing[old.Addr] = conn
+	p.mu.Unlock()
+
+	select {
+	case <-conn.connected:
+	case <-conn.done:
+		// Dropped before it was up
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.replacing[old.Addr] != conn {
+		// Dropped right when it was up
+		return
+	}
+	delete(p.replacing, old.Addr)
+	if p.connections[old.Addr] != old {
+		// The endpoint has been removed or broken meanwhile
+		p.startDrain(conn)
+		return
+	}
+	p.connections[old.Addr] = conn
+	drain(old)
+}
+
+// ReannounceServices renews proxy connections, because the enabled services are announced only when connecting.
+// Old connections keep serving until their replacements are up and aren't closed until their tunnels have finished.
+func (p *ProxyPool) ReannounceServices() {
+	for _, conn := range p.Connections() {
+		go p.replaceConnection(conn, p.startIdleDrain)
+	}
 }
 
+// UpdateEndpoints requests a new list of endpoints from the hive. It doesn't wait for the update
 func (p *ProxyPool) UpdateEndpoints() {
-	p.updateCh <- struct{}{}
+	select {
+	case p.updateCh <- struct{}{}:
+	default:
+		// An update is already pending
+	}
 }
 
 // updateConnections updates the proxy connections based on the new list of endpoints.
@@ -94,18 +458,38 @@ func (p *ProxyPool) updateConnections(ctx context.Context, endpoints []string) {
 		newEndpointsSet[ep] = struct{}{}
 	}
 
-	// Close all stale connections first
+	// Drain all stale connections first
 	for ep, conn := range p.connections {
 		if _, exists := newEndpointsSet[ep]; !exists {
-			conn.Close()
+			p.startDrain(conn)
 			delete(p.connections, ep)
 		}
 	}
+	for ep, conn := range p.replacing {
+		if _, exists := newEndpointsSet[ep]; !exists {
+			p.startDrain(conn)
+			delete(p.replacing, ep)
+		}
+	}
+
+	// Forget the history of endpoints the hive doesn't offer anymore, unless they are broken
+	p.healthMu.Lock()
+	for ep, h := range p.health {
+		if _, exists := newEndpointsSet[ep]; !exists && !h.IsBroken() {
+			delete(p.health, ep)
+		}
+	}
+	p.healthMu.Unlock()
 
 	// Add new connections
 	for _, ep := range endpoints {
 		if _, exists := p.connections[ep]; !exists {
-			conn, err := ConnectWithRetry(ctx, ep)
+			health := p.endpointHealth(ctx, ep)
+			if !health.allowConnect() {
+				logger.Warn().Str("endpoint", ep).Msg("skipping proxy endpoint with the open circuit")
+				continue
+			}
+			conn, err := ConnectWithRetry(ctx, ep, health, p.bandwidth, p.admission)
 			if err != nil {
 				logger.Err(err).Str("endpoint", ep).Msg("failed to create proxy connection, skipping")
 				continue
@@ -115,40 +499,95 @@ func (p *ProxyPool) updateConnections(ctx context.Context, endpoints []string) {
 	}
 }
 
-func getAvailableProxiesWithRetry(ctx context.Context) []string {
+// usesHive reports whether endpoints are requested from the hive
+func usesHive(cfg *config.Config) bool {
+	return len(cfg.Proxy.Endpoints) == 0 || cfg.Proxy.EndpointsMode == config.EndpointsModeMerge
+}
+
+// initialEndpoints returns endpoints known without asking the hive
+func initialEndpoints(ctx context.Context) []string {
+	cfg := config.Get()
+	if !usesHive(cfg) {
+		return nil
+	}
+	cached, err := loadCachedEndpoints(cfg.Proxy.EndpointsCache)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("unable to use proxy endpoints cache")
+	}
+	return mergeEndpoints(cfg.Proxy.Endpoints, cached)
+}
+
+// fetchEndpoints returns static endpoints and/or the ones offered by the hive according to EndpointsMode
+func (p *ProxyPool) fetchEndpoints(ctx context.Context) []string {
+	cfg := config.Get()
+	if !usesHive(cfg) {
+		return slices.Clone(cfg.Proxy.Endpoints)
+	}
+	endpoints := getAvailableProxiesWithRetry(ctx, p.BrokenEndpoints())
+	if endpoints == nil {
+		return nil
+	}
+	if err := saveCachedEndpoints(cfg.Proxy.EndpointsCache, endpoints); err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("unable to save proxy endpoints cache")
+	}
+	return mergeEndpoints(cfg.Proxy.Endpoints, endpoints)
+}
+
+// mergeEndpoints joins the lists keeping the order and dropping duplicates
+func mergeEndpoints(lists ...[]string) []string {
+	seen := map[string]struct{}{}
+	merged := []string{}
+	for _, list := range lists {
+		for _, ep := range list {
+			if _, ok := seen[ep]; !ok {
+				seen[ep] = struct{}{}
+				merged = append(merged, ep)
+			}
+		}
+	}
+	return merged
+}
+
+func getAvailableProxiesWithRetry(ctx context.Context, broken []string) []string {
 	logger := zerolog.Ctx(ctx)
-	backoff := 1 * time.Second
-	jitterFactor := 0.25
+	retry := NewRetryPolicy(config.Get().Proxy.Reconnect)
 	for {
-		jitter := time.Duration((rand.Float64() - 0.5) * jitterFactor * float64(backoff))
-		retryInterval := backoff + jitter
-		if proxies, err := getAvailableProxies(ctx); err == nil {
+		// Every attempt uses the current config, the token may have been refreshed meanwhile
+		proxies, err := getAvailableProxies(ctx, config.Get(), broken)
+		if err == nil {
 			return proxies
-		} else {
-			logger.Err(err).Msgf("failed to get available proxies, retrying in %s...", retryInterval)
 		}
-		select {
-		case <-ctx.Done():
+		retryInterval := retry.NextDelay()
+		logger.Err(err).Msgf("failed to get available proxies, retrying in %s...", retryInterval)
+		if !retry.Wait(ctx, retryInterval) {
 			return nil
-		case <-time.After(retryInterval):
 		}
-		backoff = min(backoff*2, 30*time.Second)
 	}
 }
 
-func getAvailableProxies(ctx context.Context) ([]string, error) {
-	httpc := &http.Client{
-		Timeout: 5 * time.Second,
+// Query parameter listing endpoints the agent fails to use. Hives that don't know it ignore it
+const availableProxiesBrokenParam = "broken"
+
+// getAvailableProxies requests proxy endpoints from the hive. Broken endpoints are reported, so the hive can offer others
+func getAvailableProxies(ctx context.Context, cfg *config.Config, broken []string) ([]string, error) {
+	httpc, err := outbound.NewHTTPClient(cfg, 5*time.Second)
+	if err != nil {
+		return nil, err
 	}
-	url, err := url.JoinPath(config.Cfg.Hive.Endpoint, "/api/agents/get_available_proxies")
+	endpointURL, err := url.JoinPath(cfg.Hive.Endpoint, "/api/agents/get_available_proxies")
 	if err != nil {
 		return nil, err
 	}
-	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if len(broken) > 0 {
+		endpointURL += "?" + url.Values{availableProxiesBrokenParam: broken}.Encode()
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, endpointURL, http.NoBody)
 	if err != nil {
 		return nil, err
 	}
-	r.Header.Set("Authorization", "Bearer "+config.Cfg.AuthToken)
+	if cfg.AuthToken != "" {
+		r.Header.Set("Authorization", "Bearer "+cfg.AuthToken)
+	}
 	resp, err := httpc.Do(r)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"google.golang.org/grpc/metadata"
+)
+
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyProtocolV2CmdLocal  = 0x20
+	proxyProtocolV2CmdProxy  = 0x21
+	proxyProtocolV2FamUnspec = 0x00
+	proxyProtocolV2FamTCP4   = 0x11
+	proxyProtocolV2FamTCP6   = 0x21
+
+	proxyProtocolV2TypeUniqueID   = 0x05
+	proxyProtocolV2MaxUniqueIDLen = 128
+)
+
+// proxyProtocolVersion returns the PROXY protocol version configured for the target or 0 if it's disabled
+func proxyProtocolVersion(cfg *config.Config, target tunnelTarget) int {
+	for _, pp := range cfg.Tunnel.ProxyProtocol {
+		if matchTunnelTarget(pp.Target, target) {
+			return pp.Version
+		}
+	}
+	return 0
+}
+
+// Sockets of the nginx config generated by kvmd-cloudctl and whether they expect PROXY protocol
+var cloudNginxSockets = map[string]bool{
+	"/run/kvmd/cloud-nginx-http.sock":     false,
+	"/run/kvmd/cloud-nginx-https.sock":    false,
+	"/run/kvmd/cloud-nginx-http-pp.sock":  true,
+	"/run/kvmd/cloud-nginx-https-pp.sock": true,
+}
+
+// ValidateProxyProtocol makes sure the agent sends PROXY protocol to the nginx sockets exactly when nginx expects it.
+// Otherwise every tunnel to such a socket would fail
+func ValidateProxyProtocol(cfg *config.Config) error {
+	for _, pp := range cfg.Tunnel.ProxyProtocol {
+		if pp.Version != 1 && pp.Version != 2 {
+			return fmt.Errorf("unsupported PROXY protocol version %d for %s", pp.Version, pp.Target)
+		}
+	}
+	for socket, expected := range cloudNginxSockets {
+		enabled := proxyProtocolVersion(cfg, parseTunnelTarget(socket)) != 0
+		if enabled && !expected {
+			return fmt.Errorf("nginx doesn't expect PROXY protocol on %s, use the -pp socket instead", socket)
+		}
+		if !enabled && expected {
+			return fmt.Errorf("nginx expects PROXY protocol on %s", socket)
+		}
+	}
+	return nil
+}
+
+// clientAddrFromContext extracts the cloud client address provided by the proxy in the stream metadata
+func clientAddrFromContext(ctx context.Context) (netip.AddrPort, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	values := md.Get(metadataClientAddr)
+	if len(values) == 0 {
+		return netip.AddrPort{}, false
+	}
+	addr, err := netip.ParseAddrPort(values[0])
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()), true
+}
+
+// writeProxyProtocolHeader sends the PROXY protocol header of the given version to the inner connection
+func writeProxyProtocolHeader(conn net.Conn, version int, clientAddr netip.AddrPort, hasClientAddr bool, cid string) error {
+	var header []byte
+	switch version {
+	case 1:
+		header = buildProxyProtocolV1Header(clientAddr, hasClientAddr)
+	case 2:
+		header = buildProxyProtocolV2Header(clientAddr, hasClientAddr, cid)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	_, err := conn.Write(header)
+	return err
+}
+
+func buildProxyProtocolV1Header(clientAddr netip.AddrPort, hasClientAddr bool) []byte {
+	if !hasClientAddr {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family, dst := "TCP4", "0.0.0.0"
+	if clientAddr.Addr().Is6() {
+		family, dst = "TCP6", "::"
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d 0\r\n", family, clientAddr.Addr(), dst, clientAddr.Port())
+}
+
+func buildProxyProtocolV2Header(clientAddr netip.AddrPort, hasClientAddr bool, cid string) []byte {
+	command := byte(proxyProtocolV2CmdLocal)
+	family := byte(proxyProtocolV2FamUnspec)
+	var addrs []byte
+	if hasClientAddr {
+		command = proxyProtocolV2CmdProxy
+		src := clientAddr.Addr().AsSlice()
+		if clientAddr.Addr().Is4() {
+			family = proxyProtocolV2FamTCP4
+		} else {
+			family = proxyProtocolV2FamTCP6
+		}
+		// Destination is unknown for the cloud client, so zero address of the same family is used
+		addrs = append(addrs, src...)
+		addrs = append(addrs, make([]byte, len(src))...)
+		addrs = binary.BigEndian.AppendUint16(addrs, clientAddr.Port())
+		addrs = binary.BigEndian.AppendUint16(addrs, 0)
+	}
+
+	var tlvs []byte
+	if cid != "" {
+		uniqueID := []byte(cid)
+		if len(uniqueID) > proxyProtocolV2MaxUniqueIDLen {
+			uniqueID = uniqueID[:proxyProtocolV2MaxUniqueIDLen]
+		}
+		tlvs = append(tlvs, proxyProtocolV2TypeUniqueID)
+		tlvs = binary.BigEndian.AppendUint16(tlvs, uint16(len(uniqueID)))
+		tlvs = append(tlvs, uniqueID...)
+	}
+
+	buf := bytes.Buffer{}
+	buf.Write(proxyProtocolV2Signature)
+	buf.WriteByte(command)
+	buf.WriteByte(family)
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)+len(tlvs)))
+	buf.Write(addrs)
+	buf.Write(tlvs)
+	return buf.Bytes()
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+)
+
+func TestValidateProxyProtocolDefaults(t *testing.T) {
+	cfg := config.DefConfig
+	if err := ValidateProxyProtocol(&cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateProxyProtocolNginxMismatch(t *testing.T) {
+	cases := [][]config.ProxyProtocolTarget{
+		// Plain sockets don't expect it
+		{
+			{Target: "/run/kvmd/cloud-nginx-https.sock", Version: 2},
+			{Target: "/run/kvmd/cloud-nginx-http-pp.sock", Version: 2},
+			{Target: "/run/kvmd/cloud-nginx-https-pp.sock", Version: 2},
+		},
+		{{Target: "/run/kvmd/*.sock", Version: 2}},
+		// -pp sockets do
+		{{Target: "/run/kvmd/cloud-nginx-https-pp.sock", Version: 2}},
+		nil,
+		// Unsupported version
+		{
+			{Target: "/run/kvmd/cloud-nginx-*-pp.sock", Version: 3},
+		},
+	}
+	for i, pp := range cases {
+		cfg := config.DefConfig
+		cfg.Tunnel.ProxyProtocol = pp
+		if err := ValidateProxyProtocol(&cfg); err == nil {
+			t.Errorf("case #%d: no error", i)
+		}
+	}
+}
@@ -1,15 +1,21 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	proxyagent_pb "github.com/pikvm/cloud-api/proto/proxyagent"
+	"github.com/pikvm/kvmd-cloud/internal/audit"
+	"github.com/pikvm/kvmd-cloud/internal/config"
 	"github.com/rs/zerolog"
 	"github.com/xornet-sl/go-xrpc/xrpc"
+	"google.golang.org/grpc/metadata"
 )
 
 type ProxyServer struct {
@@ -23,8 +29,32 @@ func (this *ProxyServer) ConnectionChannel(stream proxyagent_pb.AgentForProxy_Co
 		return fmt.Errorf("rpc connection is nil")
 	}
 	logger := zerolog.Ctx(rpcConn.Context())
+	// The whole tunnel uses the config current at its start
+	cfg := config.Get()
 
+	clientAddr, hasClientAddr := clientAddrFromContext(stream.Context())
+	auditRecord := audit.Record{
+		ProxyEndpoint: this.proxyConnection.Addr,
+		OpenedAt:      time.Now(),
+	}
+	if hasClientAddr {
+		auditRecord.ClientAddr = clientAddr.String()
+	}
+
+	// Recv can't be interrupted, so close the stream if the header doesn't arrive in time
+	var headerTimer *time.Timer
+	headerTimeoutErr := newTunnelError(TunnelErrorTimeout, fmt.Errorf("stream header was not received in time"))
+	if cfg.Tunnel.HeaderTimeout > 0 {
+		headerTimer = time.AfterFunc(cfg.Tunnel.HeaderTimeout, func() {
+			stream.CloseWithError(headerTimeoutErr)
+		})
+	}
 	msg, err := stream.Recv()
+	if headerTimer != nil && !headerTimer.Stop() {
+		logger.Warn().Dur("timeout", cfg.Tunnel.HeaderTimeout).Msg("stream header was not received in time, stream closed")
+		writeRejectAudit(auditRecord, headerTimeoutErr)
+		return nil
+	}
 	if errors.Is(err, xrpc.StreamClosedError) {
 		return nil
 	}
@@ -33,44 +63,118 @@ func (this *ProxyServer) ConnectionChannel(stream proxyagent_pb.AgentForProxy_Co
 		return fmt.Errorf("error while getting data from proxy: %w", err)
 	}
 	header := msg.GetHeader()
-	if header == nil {
-		logger.Warn().Msg("malformed stream header")
-		return fmt.Errorf("malformed stream header")
-	}
 	cid := header.GetCid()
-	connectTo := header.GetConnectTo()
 	cidLogger := logger.With().Str("cid", cid).Logger()
+	auditRecord.Cid = cid
+	auditRecord.Target = header.GetConnectTo()
 
-	var conn net.Conn
-	if connectTo[0] == '/' {
-		conn, err = net.Dial("unix", connectTo)
-	} else {
-		conn, err = net.Dial("tcp", connectTo)
+	if tunnelErr := validateTunnelHeader(header); tunnelErr != nil {
+		cidLogger.Warn().Err(tunnelErr).Msg("malformed stream header")
+		return rejectTunnel(stream, auditRecord, tunnelErr)
 	}
-	if err != nil {
-		return err
+	target, tunnelErr := resolveTunnelTarget(cfg, header.GetConnectTo())
+	if tunnelErr != nil {
+		cidLogger.Warn().Err(tunnelErr).Msg("rejected connection to a service that is not available")
+		return rejectTunnel(stream, auditRecord, tunnelErr)
 	}
+	auditRecord.Target = target.String()
 
-	if err := stream.Send(&proxyagent_pb.ConnectionMessage{
-		Body: &proxyagent_pb.ConnectionMessage_HeaderResponse_{
-			HeaderResponse: &proxyagent_pb.ConnectionMessage_HeaderResponse{
-				Error: "",
-			},
-		},
-	}); err != nil {
+	if !isTunnelTargetAllowed(cfg, target) {
+		tunnelErr = newTunnelError(TunnelErrorNotAllowed, fmt.Errorf("target %s is not allowed", target))
+		cidLogger.Warn().Err(tunnelErr).Msg("rejected connection to a target that is not allowed")
+		return rejectTunnel(stream, auditRecord, tunnelErr)
+	}
+
+	releaseAdmission, tunnelErr := admitTunnel(this.proxyConnection.globalAdmission, this.proxyConnection.admission)
+	if tunnelErr != nil {
+		cidLogger.Warn().Err(tunnelErr).Msg("rejected connection by admission control")
+		return rejectTunnel(stream, auditRecord, tunnelErr)
+	}
+	defer releaseAdmission()
+
+	// Checked after admission, so the drain either sees this tunnel as active or the tunnel sees the drain
+	if this.proxyConnection.IsDraining() {
+		tunnelErr = newTunnelError(TunnelErrorDraining, fmt.Errorf("proxy connection is draining"))
+		cidLogger.Info().Err(tunnelErr).Msg("rejected connection to a draining proxy connection")
+		return rejectTunnel(stream, auditRecord, tunnelErr)
+	}
+
+	conn, tunnelErr := dialTunnelTarget(stream.Context(), cfg, target)
+	if tunnelErr != nil {
+		cidLogger.Warn().Err(tunnelErr).Str("target", target.String()).Msg("unable to connect to target")
+		return rejectTunnel(stream, auditRecord, tunnelErr)
+	}
+
+	if version := proxyProtocolVersion(cfg, target); version != 0 {
+		if err := writeProxyProtocolHeader(conn, version, clientAddr, hasClientAddr, cid); err != nil {
+			conn.Close()
+			tunnelErr = newTunnelError(TunnelErrorDialFailed, fmt.Errorf("unable to send PROXY protocol header: %w", err))
+			cidLogger.Err(tunnelErr).Str("target", target.String()).Msg("unable to initialize inner connection")
+			return rejectTunnel(stream, auditRecord, tunnelErr)
+		}
+	}
+
+	if err := sendHeaderResponse(stream, ""); err != nil {
+		conn.Close()
+		auditRecord.Event = audit.EventReject
+		auditRecord.ClosedAt = time.Now()
+		auditRecord.CloseReason = "closed by proxy before start"
+		audit.Write(auditRecord)
 		return nil
 	}
 
+	tunnel := newTunnel(cfg, cid, target, this.proxyConnection.Addr)
+	this.proxyConnection.tunnels.add(tunnel)
+	defer this.proxyConnection.tunnels.remove(tunnel)
+
+	auditRecord.Event = audit.EventOpen
+	audit.Write(auditRecord)
+
 	cidLogger.Debug().Msg("Connection created")
-	defer cidLogger.Debug().Msg("Connection closed")
+	closeReason, err := this.serveTunnel(cfg.Tunnel, rpcConn, stream, conn, tunnel, cidLogger)
+	cidLogger.Debug().Str("reason", closeReason).Msg("Connection closed")
+
+	auditRecord.Event = audit.EventClose
+	auditRecord.ClosedAt = time.Now()
+	auditRecord.BytesIn = tunnel.BytesIn()
+	auditRecord.BytesOut = tunnel.BytesOut()
+	auditRecord.CloseReason = closeReason
+	audit.Write(auditRecord)
+	return err
+}
+
+// serveTunnel copies data between the proxy stream and the inner connection until one of the sides closes.
+// Returns a human readable close reason.
+func (this *ProxyServer) serveTunnel(
+	tunnelCfg config.TunnelConfigSection,
+	rpcConn *xrpc.RpcConn,
+	stream proxyagent_pb.AgentForProxy_ConnectionChannelServer,
+	conn net.Conn,
+	tunnel *Tunnel,
+	cidLogger zerolog.Logger,
+) (string, error) {
 	defer conn.Close()
 
-	senderError := make(chan error)
-	receiverError := make(chan error)
+	tunnelCtx, tunnelCancel := context.WithCancel(rpcConn.Context())
+	defer tunnelCancel()
+	shapers := []*BandwidthShaper{tunnel.bandwidth, this.proxyConnection.bandwidth, this.proxyConnection.globalBandwidth}
+	go tunnel.watchIdle(tunnelCtx, tunnelCfg.IdleTimeout.Upload, tunnelCfg.IdleTimeout.Download)
+
+	// Errors of the directions, valid once their done channels are closed
+	var senderErr, receiverErr error
+	senderDone := make(chan struct{})
+	receiverDone := make(chan struct{})
+	// Select picks at random when both directions have finished, so the first one is recorded explicitly
+	var firstFinished atomic.Int32
+	proxyEOF := make(chan struct{})
+	halfClose := streamSupportsHalfClose(stream.Context())
 
 	// Proxy -> Inner socket
 	go func() {
-		defer close(senderError)
+		defer func() {
+			firstFinished.CompareAndSwap(directionNone, directionProxyToInner)
+			close(senderDone)
+		}()
 		for {
 			msg, err := stream.Recv()
 			if isNetConnClosedErr(err) || errors.Is(err, xrpc.StreamClosedError) {
@@ -82,31 +186,50 @@ func (this *ProxyServer) ConnectionChannel(stream proxyagent_pb.AgentForProxy_Co
 			if err != nil {
 				cidLogger.Err(err).Msg("error while getting data from proxy")
 				conn.Close()
-				senderError <- err
+				senderErr = err
 				return
 			}
 			chunk := msg.GetChunk()
+			if len(chunk) == 0 && !halfClose {
+				continue
+			}
+			if len(chunk) == 0 {
+				// Proxy finished sending. Keep the inner->proxy direction alive
+				cidLogger.Trace().Msg("proxy->inner end of stream")
+				select {
+				case <-proxyEOF:
+				default:
+					close(proxyEOF)
+					closeWrite(conn)
+				}
+				continue
+			}
 			cidLogger.Trace().Msgf("proxy->inner rpc received %d bytes", len(chunk))
+			if err := waitDownload(tunnelCtx, len(chunk), shapers...); err != nil {
+				conn.Close()
+				return
+			}
 			n, err := conn.Write(chunk)
+			tunnel.addBytesIn(n)
 			cidLogger.Trace().Msgf("inner written %d bytes", n)
 			if err != nil {
 				cidLogger.Err(err).Msg("unable to send data to inner connection")
 				conn.Close()
 				// apiHandler.Notify(apiHandler.Ctx, "connectionClosed", connection.Cid)
-				senderError <- err
+				senderErr = err
 				return
 			}
 		}
 	}()
 	// Inner socket -> Proxy
 	go func() {
-		defer close(receiverError)
+		defer func() {
+			firstFinished.CompareAndSwap(directionNone, directionInnerToProxy)
+			close(receiverDone)
+		}()
 		readCloserChan := make(chan struct{})
 		go func() {
-			connCtx := this.proxyConnection.GetRpcConn().Context()
-			if connCtx == nil {
-				return
-			}
+			connCtx := rpcConn.Context()
 			select {
 			case <-connCtx.Done():
 				conn.Close()
@@ -120,12 +243,23 @@ func (this *ProxyServer) ConnectionChannel(stream proxyagent_pb.AgentForProxy_Co
 		for {
 			n, err := conn.Read(buff)
 			cidLogger.Trace().Msgf("inner read: %d bytes", n)
-			if isNetConnClosedErr(err) {
+			if errors.Is(err, io.EOF) && halfClose {
+				// Inner side finished sending. Signal the end of stream to the proxy with an empty chunk
+				cidLogger.Trace().Msg("inner->proxy end of stream")
+				if err := sendEOF(stream); err != nil && !errors.Is(err, xrpc.StreamClosedError) {
+					receiverErr = err
+				}
+				return
+			} else if isNetConnClosedErr(err) {
 				return
 			} else if err != nil {
 				cidLogger.Err(err).Msg("error reading from inner connection")
 				conn.Close()
-				receiverError <- err
+				receiverErr = err
+				return
+			}
+			if err := waitUpload(tunnelCtx, n, shapers...); err != nil {
+				conn.Close()
 				return
 			}
 			err = stream.Send(&proxyagent_pb.ConnectionMessage{
@@ -141,27 +275,124 @@ func (this *ProxyServer) ConnectionChannel(stream proxyagent_pb.AgentForProxy_Co
 			if err != nil {
 				cidLogger.Err(err).Msg("unable to send data to proxy")
 				conn.Close()
-				receiverError <- err
+				receiverErr = err
 				return
 			}
+			tunnel.addBytesOut(n)
 			cidLogger.Trace().Msgf("inner->proxy rpc sent %d bytes", n)
 		}
 	}()
 
-	proxyConn := this.proxyConnection.GetRpcConn().Context()
-	if proxyConn == nil {
-		return nil
+	proxyConn := rpcConn.Context()
+	select {
+	case <-proxyConn.Done():
+		return "proxy connection lost", nil
+	case <-tunnel.Killed():
+		cidLogger.Info().Str("reason", tunnel.KillReason()).Msg("Connection closed by agent")
+		return tunnel.KillReason(), nil
+	case <-senderDone:
+	case <-receiverDone:
+	}
+	if firstFinished.Load() == directionProxyToInner {
+		if senderErr != nil {
+			return fmt.Sprintf("proxy->inner error: %s", senderErr), senderErr
+		}
+		return "closed by proxy", nil
+	}
+	if receiverErr != nil {
+		return fmt.Sprintf("inner->proxy error: %s", receiverErr), receiverErr
 	}
+	if !halfClose {
+		return "closed by inner", nil
+	}
+
+	// Inner side has finished. Let the proxy finish its side, but not longer than the linger timeout
+	lingerTimer := time.NewTimer(tunnelCfg.Linger)
+	defer lingerTimer.Stop()
 	select {
 	case <-proxyConn.Done():
-		return nil
-	case err := <-senderError:
-		return err
-	case err := <-receiverError:
-		return err
+		return "proxy connection lost", nil
+	case <-proxyEOF:
+		return "closed by both sides", nil
+	case <-lingerTimer.C:
+		cidLogger.Debug().Msg("linger timeout expired, closing connection")
+		return "closed by inner, linger timeout expired", nil
+	case <-tunnel.Killed():
+		cidLogger.Info().Str("reason", tunnel.KillReason()).Msg("Connection closed by agent")
+		return tunnel.KillReason(), nil
+	case <-senderDone:
+		if senderErr != nil {
+			return fmt.Sprintf("proxy->inner error: %s", senderErr), senderErr
+		}
+		select {
+		case <-proxyEOF:
+			return "closed by both sides", nil
+		default:
+			return "closed by proxy", nil
+		}
 	}
 }
 
+// Directions of a tunnel for the close reason
+const (
+	directionNone int32 = iota
+	directionProxyToInner
+	directionInnerToProxy
+)
+
+// rejectTunnel reports the error to the proxy and records the rejected tunnel to the audit log
+func rejectTunnel(stream proxyagent_pb.AgentForProxy_ConnectionChannelServer, auditRecord audit.Record, tunnelErr *TunnelError) error {
+	writeRejectAudit(auditRecord, tunnelErr)
+	return sendHeaderResponse(stream, tunnelErr.Error())
+}
+
+// writeRejectAudit records the rejected tunnel with the error code as the close reason
+func writeRejectAudit(auditRecord audit.Record, tunnelErr *TunnelError) {
+	auditRecord.Event = audit.EventReject
+	auditRecord.ClosedAt = time.Now()
+	auditRecord.CloseReason = tunnelErr.Error()
+	audit.Write(auditRecord)
+}
+
+// sendEOF sends an empty chunk which means the end of stream in this direction
+func sendEOF(stream proxyagent_pb.AgentForProxy_ConnectionChannelServer) error {
+	return stream.Send(&proxyagent_pb.ConnectionMessage{
+		Body: &proxyagent_pb.ConnectionMessage_Chunk{
+			Chunk: []byte{},
+		},
+	})
+}
+
+// streamSupportsHalfClose reports whether the proxy announced the half-close capability for the stream.
+// Older proxies treat an empty chunk as a no-op and end the stream when either side closes.
+func streamSupportsHalfClose(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	values := md.Get(metadataHalfClose)
+	return len(values) > 0 && values[0] == "1"
+}
+
+// closeWrite shuts down the writing side of the connection if it's supported, otherwise closes it completely
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+func sendHeaderResponse(stream proxyagent_pb.AgentForProxy_ConnectionChannelServer, errorMsg string) error {
+	return stream.Send(&proxyagent_pb.ConnectionMessage{
+		Body: &proxyagent_pb.ConnectionMessage_HeaderResponse_{
+			HeaderResponse: &proxyagent_pb.ConnectionMessage_HeaderResponse{
+				Error: errorMsg,
+			},
+		},
+	})
+}
+
 func isNetConnClosedErr(err error) bool {
 	switch {
 	case
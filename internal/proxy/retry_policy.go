@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+)
+
+// clock abstracts time for the retry policy, so it can be driven manually
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// RetryPolicy computes delays between attempts using exponential backoff with jitter
+type RetryPolicy struct {
+	cfg     config.ReconnectConfigSection
+	clock   clock
+	rand    func() float64
+	current time.Duration
+}
+
+func NewRetryPolicy(cfg config.ReconnectConfigSection) *RetryPolicy {
+	return newRetryPolicy(cfg, realClock{}, rand.Float64)
+}
+
+func newRetryPolicy(cfg config.ReconnectConfigSection, clk clock, rnd func() float64) *RetryPolicy {
+	r := &RetryPolicy{
+		cfg:   cfg,
+		clock: clk,
+		rand:  rnd,
+	}
+	r.Reset()
+	return r
+}
+
+// Reset starts the backoff over from the initial interval
+func (r *RetryPolicy) Reset() {
+	r.current = max(r.cfg.InitialInterval, 0)
+}
+
+// NextDelay returns the delay before the next attempt and increases the backoff
+func (r *RetryPolicy) NextDelay() time.Duration {
+	backoff := r.current
+	maxInterval := max(r.cfg.MaxInterval, r.cfg.InitialInterval)
+	r.current = min(time.Duration(float64(r.current)*max(r.cfg.Multiplier, 1)), maxInterval)
+
+	jitter := time.Duration((r.rand() - 0.5) * r.cfg.Jitter * float64(backoff))
+	return max(backoff+jitter, 0)
+}
+
+// ConnectionLost resets the backoff if the connection has been up for at least ResetAfter
+func (r *RetryPolicy) ConnectionLost(connectedSince time.Time) {
+	if r.cfg.ResetAfter > 0 && !connectedSince.IsZero() && r.clock.Now().Sub(connectedSince) >= r.cfg.ResetAfter {
+		r.Reset()
+	}
+}
+
+// Wait sleeps for the delay. Returns false if ctx is done earlier
+func (r *RetryPolicy) Wait(ctx context.Context, delay time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-r.clock.After(delay):
+		return true
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+)
+
+type fakeClock struct {
+	now   time.Time
+	after chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:   time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		after: make(chan time.Time),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.after
+}
+
+func fixedRand(v float64) func() float64 {
+	return func() float64 { return v }
+}
+
+func testReconnectConfig() config.ReconnectConfigSection {
+	return config.ReconnectConfigSection{
+		InitialInterval: time.Second,
+		MaxInterval:     10 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.5,
+		ResetAfter:      time.Minute,
+	}
+}
+
+func TestRetryPolicyGrowsUpToMaxInterval(t *testing.T) {
+	cfg := testReconnectConfig()
+	cfg.Jitter = 0
+	r := newRetryPolicy(cfg, newFakeClock(), fixedRand(0.5))
+
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for i, want := range expected {
+		if got := r.NextDelay(); got != want {
+			t.Fatalf("delay #%d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestRetryPolicyJitterBounds(t *testing.T) {
+	cases := []struct {
+		rand float64
+		want time.Duration
+	}{
+		{0, 750 * time.Millisecond},
+		{0.5, time.Second},
+		{0.999, time.Second + 249500*time.Microsecond},
+	}
+	for _, c := range cases {
+		r := newRetryPolicy(testReconnectConfig(), newFakeClock(), fixedRand(c.rand))
+		if got := r.NextDelay(); got != c.want {
+			t.Errorf("rand %v: got %v, want %v", c.rand, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicyJitterNeverNegative(t *testing.T) {
+	cfg := testReconnectConfig()
+	cfg.Jitter = 3
+	r := newRetryPolicy(cfg, newFakeClock(), fixedRand(0))
+	if got := r.NextDelay(); got != 0 {
+		t.Fatalf("got %v, want 0", got)
+	}
+}
+
+func TestRetryPolicyConnectionLostResets(t *testing.T) {
+	clk := newFakeClock()
+	r := newRetryPolicy(testReconnectConfig(), clk, fixedRand(0.5))
+	r.NextDelay()
+	r.NextDelay()
+
+	r.ConnectionLost(clk.now.Add(-time.Minute))
+	if got := r.NextDelay(); got != time.Second {
+		t.Fatalf("got %v after a long connection, want the initial interval", got)
+	}
+}
+
+func TestRetryPolicyConnectionLostKeepsBackoff(t *testing.T) {
+	clk := newFakeClock()
+	r := newRetryPolicy(testReconnectConfig(), clk, fixedRand(0.5))
+	r.NextDelay()
+	r.NextDelay()
+
+	r.ConnectionLost(clk.now.Add(-time.Minute + time.Second))
+	if got := r.NextDelay(); got != 4*time.Second {
+		t.Fatalf("got %v after a short connection, want 4s", got)
+	}
+
+	r.ConnectionLost(time.Time{})
+	if got := r.NextDelay(); got != 8*time.Second {
+		t.Fatalf("got %v after a connection that was never up, want 8s", got)
+	}
+}
+
+func TestRetryPolicyWaitCancelled(t *testing.T) {
+	r := newRetryPolicy(testReconnectConfig(), newFakeClock(), fixedRand(0.5))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if r.Wait(ctx, time.Hour) {
+		t.Fatal("Wait returned true with a cancelled context")
+	}
+}
+
+func TestRetryPolicyWaitElapsed(t *testing.T) {
+	clk := newFakeClock()
+	r := newRetryPolicy(testReconnectConfig(), clk, fixedRand(0.5))
+	go func() { clk.after <- clk.now }()
+	if !r.Wait(context.Background(), time.Hour) {
+		t.Fatal("Wait returned false after the delay elapsed")
+	}
+}
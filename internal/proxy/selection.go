@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/pikvm/kvmd-cloud/internal/outbound"
+	"github.com/rs/zerolog"
+)
+
+type endpointProbe struct {
+	endpoint string
+	latency  time.Duration
+	err      error
+}
+
+// selectBestEndpoints probes the offered endpoints and returns up to Count ones with the fastest handshake.
+// Connected endpoints get a bonus of Hysteresis, so they are replaced only by noticeably faster ones.
+func (p *ProxyPool) selectBestEndpoints(ctx context.Context, cfg *config.Config, endpoints []string) []string {
+	logger := zerolog.Ctx(ctx)
+	selection := cfg.Proxy.Selection
+
+	p.mu.RLock()
+	connected := make(map[string]struct{}, len(p.connections))
+	for ep := range p.connections {
+		connected[ep] = struct{}{}
+	}
+	p.mu.RUnlock()
+
+	p.healthMu.Lock()
+	candidates := []string{}
+	for _, ep := range endpoints {
+		if h, ok := p.health[ep]; ok && h.IsBroken() {
+			continue
+		}
+		candidates = append(candidates, ep)
+	}
+	p.healthMu.Unlock()
+
+	if len(candidates) <= selection.Count {
+		return endpoints
+	}
+
+	probes := probeEndpoints(ctx, cfg, candidates)
+	ranked := []endpointProbe{}
+	for _, probe := range probes {
+		if probe.err != nil {
+			logger.Warn().Err(probe.err).Str("endpoint", probe.endpoint).Msg("proxy endpoint probe failed")
+			continue
+		}
+		ranked = append(ranked, probe)
+	}
+	if len(ranked) == 0 {
+		// Probes may be blocked on the way, so the hive's order is the best guess
+		logger.Warn().Msg("all proxy endpoint probes failed, selecting endpoints as offered by the hive")
+		return candidates[:selection.Count]
+	}
+
+	effective := func(probe endpointProbe) time.Duration {
+		if _, ok := connected[probe.endpoint]; ok {
+			return time.Duration(float64(probe.latency) * (1 - selection.Hysteresis))
+		}
+		return probe.latency
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return effective(ranked[i]) < effective(ranked[j])
+	})
+
+	selected := []string{}
+	for _, probe := range ranked[:min(selection.Count, len(ranked))] {
+		selected = append(selected, probe.endpoint)
+		logger.Debug().Str("endpoint", probe.endpoint).Dur("latency", probe.latency).Msg("proxy endpoint selected")
+	}
+	return selected
+}
+
+// probeEndpoints measures the time of TCP connect plus TLS handshake to each endpoint concurrently.
+// Behind an outbound proxy that includes connecting through the proxy.
+func probeEndpoints(ctx context.Context, cfg *config.Config, endpoints []string) []endpointProbe {
+	var tlsConfig *tls.Config
+	dialer, err := outbound.NewDialer(cfg.OutboundProxy)
+	if err == nil && !cfg.NoSSL {
+		tlsConfig, err = outbound.TLSConfig(cfg.SSL)
+	}
+	if err != nil {
+		probes := make([]endpointProbe, len(endpoints))
+		for i, ep := range endpoints {
+			probes[i] = endpointProbe{endpoint: ep, err: err}
+		}
+		return probes
+	}
+
+	probes := make([]endpointProbe, len(endpoints))
+	wg := sync.WaitGroup{}
+	for i, ep := range endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			latency, err := probeEndpoint(ctx, dialer, ep, tlsConfig, cfg.Proxy.Selection.ProbeTimeout)
+			probes[i] = endpointProbe{endpoint: ep, latency: latency, err: err}
+		}()
+	}
+	wg.Wait()
+	return probes
+}
+
+func probeEndpoint(ctx context.Context, dialer *outbound.Dialer, endpoint string, tlsConfig *tls.Config, timeout time.Duration) (time.Duration, error) {
+	hostport, host, err := endpointAddress(endpoint, tlsConfig != nil)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	startedAt := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", hostport)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if tlsConfig != nil {
+		if err := tls.Client(conn, outbound.ForHost(tlsConfig, host)).HandshakeContext(ctx); err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(startedAt), nil
+}
+
+// endpointAddress returns host:port to dial for the endpoint in the form accepted by xrpc Dial
+func endpointAddress(endpoint string, useTLS bool) (hostport string, host string, err error) {
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		if u, err = url.Parse(scheme + "://" + endpoint); err != nil {
+			return "", "", fmt.Errorf("invalid proxy endpoint %q: %w", endpoint, err)
+		}
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	return net.JoinHostPort(u.Hostname(), port), u.Hostname(), nil
+}
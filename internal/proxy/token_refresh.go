@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pikvm/cloud-api/api_models"
+	"github.com/pikvm/kvmd-cloud/internal/config"
+	"github.com/pikvm/kvmd-cloud/internal/outbound"
+	"github.com/rs/zerolog"
+)
+
+// The schedule is rechecked at least this often to pick up tokens and settings from a reloaded config
+const tokenCheckInterval = 1 * time.Minute
+
+type tokenRefreshResult struct {
+	AuthToken string `json:"auth_token"`
+}
+
+// RunTokenRefresh refreshes the auth token from the hive before it expires.
+// The new token is used for new proxy connections, established ones are kept.
+// While refreshes fail, the current token stays in use.
+func RunTokenRefresh(ctx context.Context) {
+	logger := zerolog.Ctx(ctx)
+	retry := NewRetryPolicy(config.Get().Proxy.Reconnect)
+	// For tokens without an expiry time the interval is counted from the last refresh
+	refreshedAt := time.Now()
+	for {
+		cfg := config.Get()
+		token := cfg.AuthToken
+		wait := tokenCheckInterval
+		if refreshAt, ok := tokenRefreshTime(token, refreshedAt, cfg.TokenRefresh); ok {
+			wait = min(time.Until(refreshAt), tokenCheckInterval)
+		}
+		if wait > 0 {
+			if !retry.Wait(ctx, wait) {
+				return
+			}
+			continue
+		}
+
+		newToken, err := refreshAuthToken(ctx, cfg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			retryInterval := retry.NextDelay()
+			if expiresAt, ok := tokenExpiry(token); ok && time.Now().After(expiresAt) {
+				logger.Err(err).Msgf("Auth token has expired and can't be refreshed, retrying in %s...", retryInterval)
+			} else {
+				logger.Warn().Err(err).Msgf("Unable to refresh auth token, keeping the current one, retrying in %s...", retryInterval)
+			}
+			if !retry.Wait(ctx, retryInterval) {
+				return
+			}
+			continue
+		}
+		retry.Reset()
+		refreshedAt = time.Now()
+		replaced, err := config.SetAuthToken(token, newToken)
+		if !replaced {
+			logger.Info().Msg("Auth token has changed during the refresh, the refreshed one is discarded")
+			continue
+		}
+		if err != nil {
+			logger.Err(err).Msg("Unable to save refreshed auth token, the previous one will be used after restart")
+		}
+		event := logger.Info()
+		if expiresAt, ok := tokenExpiry(newToken); ok {
+			event = event.Time("expires_at", expiresAt)
+		}
+		event.Msg("Auth token refreshed")
+	}
+}
+
+// tokenRefreshTime returns when the token should be refreshed, or false if it shouldn't
+func tokenRefreshTime(token string, refreshedAt time.Time, cfg config.TokenRefreshConfigSection) (time.Time, bool) {
+	if !cfg.Enabled || token == "" {
+		return time.Time{}, false
+	}
+	if expiresAt, ok := tokenExpiry(token); ok {
+		refreshAt := expiresAt.Add(-cfg.Window)
+		// Tokens living shorter than the window are refreshed in the middle of their remaining life
+		if refreshAt.Before(refreshedAt) {
+			refreshAt = refreshedAt.Add(expiresAt.Sub(refreshedAt) / 2)
+		}
+		return refreshAt, true
+	}
+	if cfg.Interval > 0 {
+		return refreshedAt.Add(cfg.Interval), true
+	}
+	return time.Time{}, false
+}
+
+// tokenExpiry returns the exp claim of a JWT. The signature is not verified, it's only used for scheduling
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// refreshAuthToken exchanges the token of the config for a new one
+func refreshAuthToken(ctx context.Context, cfg *config.Config) (string, error) {
+	httpc, err := outbound.NewHTTPClient(cfg, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	endpointURL, err := url.JoinPath(cfg.Hive.Endpoint, "/api/agents/refresh_token")
+	if err != nil {
+		return "", err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointURL, http.NoBody)
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Authorization", "Bearer "+cfg.AuthToken)
+	resp, err := httpc.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	result := tokenRefreshResult{}
+	response := api_models.ResponseModel{Result: &result}
+	if err := json.Unmarshal(respBytes, &response); err != nil {
+		return "", err
+	}
+	if response.Error != nil {
+		return "", response.Error.ToDomainError()
+	}
+	if result.AuthToken == "" {
+		return "", errors.New("hive returned an empty auth token")
+	}
+	return result.AuthToken, nil
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// TunnelErrorCode is a stable error identifier sent back to the proxy in HeaderResponse.Error.
+// The cloud relies on these values to show a meaningful reason to the user, so never rename them.
+type TunnelErrorCode string
+
+const (
+	TunnelErrorRefused         TunnelErrorCode = "refused"
+	TunnelErrorTimeout         TunnelErrorCode = "timeout"
+	TunnelErrorNotAllowed      TunnelErrorCode = "not_allowed"
+	TunnelErrorMalformedHeader TunnelErrorCode = "malformed_header"
+	TunnelErrorNoSuchSocket    TunnelErrorCode = "no_such_socket"
+	TunnelErrorDialFailed      TunnelErrorCode = "dial_failed"
+	TunnelErrorTooManyTunnels  TunnelErrorCode = "too_many_tunnels"
+	TunnelErrorRateLimited     TunnelErrorCode = "rate_limited"
+	TunnelErrorUnknownService  TunnelErrorCode = "unknown_service"
+	TunnelErrorServiceDisabled TunnelErrorCode = "service_disabled"
+	TunnelErrorDraining        TunnelErrorCode = "draining"
+)
+
+type TunnelError struct {
+	Code TunnelErrorCode
+	Err  error
+}
+
+func newTunnelError(code TunnelErrorCode, err error) *TunnelError {
+	return &TunnelError{Code: code, Err: err}
+}
+
+// Error returns the message in "<code>: <details>" form
+func (e *TunnelError) Error() string {
+	if e.Err == nil {
+		return string(e.Code)
+	}
+	return string(e.Code) + ": " + e.Err.Error()
+}
+
+func (e *TunnelError) Unwrap() error {
+	return e.Err
+}
+
+// classifyDialError maps an error returned by the dialer to a tunnel error code
+func classifyDialError(err error) *TunnelError {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return newTunnelError(TunnelErrorRefused, err)
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return newTunnelError(TunnelErrorTimeout, err)
+	case errors.Is(err, syscall.ENOENT):
+		return newTunnelError(TunnelErrorNoSuchSocket, err)
+	default:
+		return newTunnelError(TunnelErrorDialFailed, err)
+	}
+}
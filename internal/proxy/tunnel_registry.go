@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pikvm/kvmd-cloud/internal/config"
+)
+
+// Tunnel describes a single active ConnectionChannel stream
+type Tunnel struct {
+	Cid           string
+	Target        string
+	ProxyEndpoint string
+	StartedAt     time.Time
+
+	bytesIn  atomic.Uint64 // proxy -> inner
+	bytesOut atomic.Uint64 // inner -> proxy
+	lastIn   atomic.Int64  // unix nanoseconds
+	lastOut  atomic.Int64  // unix nanoseconds
+
+	bandwidth *BandwidthShaper
+
+	killOnce   sync.Once
+	killed     chan struct{}
+	killReason string
+}
+
+func newTunnel(cfg *config.Config, cid string, target tunnelTarget, proxyEndpoint string) *Tunnel {
+	now := time.Now()
+	tunnel := &Tunnel{
+		Cid:           cid,
+		Target:        target.String(),
+		ProxyEndpoint: proxyEndpoint,
+		StartedAt:     now,
+		bandwidth:     NewBandwidthShaper(cfg.Tunnel.Bandwidth.PerTunnel),
+		killed:        make(chan struct{}),
+	}
+	tunnel.lastIn.Store(now.UnixNano())
+	tunnel.lastOut.Store(now.UnixNano())
+	return tunnel
+}
+
+func (t *Tunnel) BytesIn() uint64 {
+	return t.bytesIn.Load()
+}
+
+func (t *Tunnel) BytesOut() uint64 {
+	return t.bytesOut.Load()
+}
+
+func (t *Tunnel) LastActivity() time.Time {
+	return time.Unix(0, max(t.lastIn.Load(), t.lastOut.Load()))
+}
+
+// Kill asks the tunnel to terminate. It's safe to call it multiple times, only the first reason is kept
+func (t *Tunnel) Kill(reason string) {
+	t.killOnce.Do(func() {
+		t.killReason = reason
+		close(t.killed)
+	})
+}
+
+// Killed is closed when the tunnel was asked to terminate
+func (t *Tunnel) Killed() <-chan struct{} {
+	return t.killed
+}
+
+// KillReason returns the reason passed to Kill. Valid only after Killed is closed
+func (t *Tunnel) KillReason() string {
+	return t.killReason
+}
+
+func (t *Tunnel) addBytesIn(n int) {
+	t.bytesIn.Add(uint64(n))
+	t.lastIn.Store(time.Now().UnixNano())
+}
+
+func (t *Tunnel) addBytesOut(n int) {
+	t.bytesOut.Add(uint64(n))
+	t.lastOut.Store(time.Now().UnixNano())
+}
+
+// watchIdle kills the tunnel if there was no traffic in some direction for longer than its timeout.
+// Zero timeout disables the check for the direction. Returns when ctx is done or the tunnel is killed.
+func (t *Tunnel) watchIdle(ctx context.Context, uploadTimeout time.Duration, downloadTimeout time.Duration) {
+	interval := time.Duration(0)
+	for _, timeout := range []time.Duration{uploadTimeout, downloadTimeout} {
+		if timeout > 0 && (interval == 0 || timeout < interval) {
+			interval = timeout
+		}
+	}
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(max(interval/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.killed:
+			return
+		case now := <-ticker.C:
+			if downloadTimeout > 0 && now.Sub(time.Unix(0, t.lastIn.Load())) > downloadTimeout {
+				t.Kill(fmt.Sprintf("idle timeout: no data from proxy for %s", downloadTimeout))
+				return
+			}
+			if uploadTimeout > 0 && now.Sub(time.Unix(0, t.lastOut.Load())) > uploadTimeout {
+				t.Kill(fmt.Sprintf("idle timeout: no data from inner connection for %s", uploadTimeout))
+				return
+			}
+		}
+	}
+}
+
+// TunnelRegistry keeps track of active tunnels of a single proxy connection
+type TunnelRegistry struct {
+	mu      sync.RWMutex
+	tunnels map[string]*Tunnel
+}
+
+func NewTunnelRegistry() *TunnelRegistry {
+	return &TunnelRegistry{
+		tunnels: make(map[string]*Tunnel),
+	}
+}
+
+func (r *TunnelRegistry) add(tunnel *Tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tunnels[tunnel.Cid] = tunnel
+}
+
+func (r *TunnelRegistry) remove(tunnel *Tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The cid may be reused by the proxy, so only remove the exact same tunnel
+	if r.tunnels[tunnel.Cid] == tunnel {
+		delete(r.tunnels, tunnel.Cid)
+	}
+}
+
+// Get returns an active tunnel by cid or nil
+func (r *TunnelRegistry) Get(cid string) *Tunnel {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.tunnels[cid]
+}
+
+// List returns active tunnels sorted by start time
+func (r *TunnelRegistry) List() []*Tunnel {
+	r.mu.RLock()
+	tunnels := make([]*Tunnel, 0, len(r.tunnels))
+	for _, tunnel := range r.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	r.mu.RUnlock()
+	sortTunnels(tunnels)
+	return tunnels
+}
+
+func (r *TunnelRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.tunnels)
+}
+
+func sortTunnels(tunnels []*Tunnel) {
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].StartedAt.Before(tunnels[j].StartedAt)
+	})
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+
+	proxyagent_pb "github.com/pikvm/cloud-api/proto/proxyagent"
+	"github.com/pikvm/kvmd-cloud/internal/config"
+)
+
+type tunnelTarget struct {
+	Network string // "unix" or "tcp"
+	Address string
+	Service string // Logical service name if the target was resolved from the services config
+}
+
+func (t tunnelTarget) String() string {
+	if t.Service != "" {
+		return t.Service + "=" + t.Network + ":" + t.Address
+	}
+	return t.Network + ":" + t.Address
+}
+
+// parseTunnelTarget converts a connect_to value received from the proxy to a dialable target.
+// Absolute paths are treated as unix sockets, everything else as TCP host:port.
+func parseTunnelTarget(connectTo string) tunnelTarget {
+	if strings.HasPrefix(connectTo, "/") {
+		return tunnelTarget{Network: "unix", Address: filepath.Clean(connectTo)}
+	}
+	return tunnelTarget{Network: "tcp", Address: connectTo}
+}
+
+// validateTunnelHeader checks the stream header sent by the proxy
+func validateTunnelHeader(header *proxyagent_pb.ConnectionMessage_Header) *TunnelError {
+	if header == nil {
+		return newTunnelError(TunnelErrorMalformedHeader, fmt.Errorf("stream header is missing"))
+	}
+	if header.GetCid() == "" {
+		return newTunnelError(TunnelErrorMalformedHeader, fmt.Errorf("cid is empty"))
+	}
+	connectTo := header.GetConnectTo()
+	if connectTo == "" {
+		return newTunnelError(TunnelErrorMalformedHeader, fmt.Errorf("connect_to is empty"))
+	}
+	if isServiceName(connectTo) {
+		return nil
+	}
+	if target := parseTunnelTarget(connectTo); target.Network == "tcp" {
+		if _, _, err := net.SplitHostPort(target.Address); err != nil {
+			return newTunnelError(TunnelErrorMalformedHeader, fmt.Errorf("invalid connect_to: %w", err))
+		}
+	}
+	return nil
+}
+
+// resolveTunnelTarget returns the target to connect to for a validated connect_to value
+func resolveTunnelTarget(cfg *config.Config, connectTo string) (tunnelTarget, *TunnelError) {
+	if isServiceName(connectTo) {
+		return resolveService(cfg, connectTo)
+	}
+	return parseTunnelTarget(connectTo), nil
+}
+
+// isServiceName reports whether connect_to is a logical service name rather than a socket path or host:port
+func isServiceName(connectTo string) bool {
+	return !strings.HasPrefix(connectTo, "/") && !strings.Contains(connectTo, ":")
+}
+
+// resolveService looks up the logical service name in the services config
+func resolveService(cfg *config.Config, name string) (tunnelTarget, *TunnelError) {
+	service, ok := cfg.Services[name]
+	if !ok || service.Target == "" {
+		return tunnelTarget{}, newTunnelError(TunnelErrorUnknownService, fmt.Errorf("service %q is not configured", name))
+	}
+	if !service.Enabled {
+		return tunnelTarget{}, newTunnelError(TunnelErrorServiceDisabled, fmt.Errorf("service %q is disabled", name))
+	}
+	target := parseTunnelTarget(service.Target)
+	target.Service = name
+	return target, nil
+}
+
+// dialTunnelTarget connects to the target respecting the configured dial timeout
+func dialTunnelTarget(ctx context.Context, cfg *config.Config, target tunnelTarget) (net.Conn, *TunnelError) {
+	dialer := net.Dialer{Timeout: cfg.Tunnel.DialTimeout}
+	conn, err := dialer.DialContext(ctx, target.Network, target.Address)
+	if err != nil {
+		return nil, classifyDialError(err)
+	}
+	return conn, nil
+}
+
+// isTunnelTargetAllowed checks the target against the tunnel allowlist from the config.
+// Targets of locally configured services are always allowed. Raw targets of disabled services never are,
+// otherwise disabling a service would not stop the proxy from reaching it.
+func isTunnelTargetAllowed(cfg *config.Config, target tunnelTarget) bool {
+	if target.Service != "" {
+		return true
+	}
+	if disabledServiceOf(cfg, target) != "" {
+		return false
+	}
+	patterns := cfg.Tunnel.AllowedTCPTargets
+	if target.Network == "unix" {
+		patterns = cfg.Tunnel.AllowedUnixSockets
+	}
+	for _, pattern := range patterns {
+		if matchTunnelTarget(pattern, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// disabledServiceOf returns the name of a disabled service with the same target, if any
+func disabledServiceOf(cfg *config.Config, target tunnelTarget) string {
+	for name, service := range cfg.Services {
+		if service.Enabled || service.Target == "" {
+			continue
+		}
+		serviceTarget := parseTunnelTarget(service.Target)
+		if serviceTarget.Network != target.Network {
+			continue
+		}
+		if serviceTarget.Address == target.Address ||
+			(target.Network == "tcp" && strings.EqualFold(serviceTarget.Address, target.Address)) {
+			return name
+		}
+	}
+	return ""
+}
+
+// matchTunnelTarget checks the target against a unix socket path or TCP host:port glob pattern
+func matchTunnelTarget(pattern string, target tunnelTarget) bool {
+	if strings.HasPrefix(pattern, "/") {
+		if target.Network != "unix" {
+			return false
+		}
+		ok, _ := filepath.Match(pattern, target.Address)
+		return ok
+	}
+	if target.Network != "tcp" {
+		return false
+	}
+	host, port, err := net.SplitHostPort(target.Address)
+	if err != nil {
+		return false
+	}
+	patternHost, patternPort, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return false
+	}
+	hostOk, _ := path.Match(strings.ToLower(patternHost), strings.ToLower(host))
+	portOk, _ := path.Match(patternPort, port)
+	return hostOk && portOk
+}
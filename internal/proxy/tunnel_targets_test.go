@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"testing"
+
+	proxyagent_pb "github.com/pikvm/cloud-api/proto/proxyagent"
+	"github.com/pikvm/kvmd-cloud/internal/config"
+)
+
+func testTargetsConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.Tunnel.AllowedUnixSockets = []string{"/run/kvmd/*.sock"}
+	cfg.Tunnel.AllowedTCPTargets = []string{"127.0.0.1:*"}
+	cfg.Services = map[string]config.ServiceConfig{
+		"web": {Enabled: true, Target: "/run/kvmd/cloud-nginx-https.sock"},
+		"vnc": {Enabled: false, Target: "127.0.0.1:5900"},
+		"old": {Enabled: false, Target: "/run/kvmd/../kvmd/old.sock"},
+	}
+	return cfg
+}
+
+func TestTunnelTargetAllowlist(t *testing.T) {
+	cfg := testTargetsConfig()
+	cases := []struct {
+		connectTo string
+		want      bool
+	}{
+		{"/run/kvmd/cloud-nginx-https.sock", true},
+		{"/run/kvmd/other.sock", true},
+		{"/run/other.sock", false},
+		{"127.0.0.1:22", true},
+		{"10.0.0.1:22", false},
+	}
+	for _, c := range cases {
+		if got := isTunnelTargetAllowed(cfg, parseTunnelTarget(c.connectTo)); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.connectTo, got, c.want)
+		}
+	}
+}
+
+func TestTunnelTargetOfDisabledServiceRejected(t *testing.T) {
+	cfg := testTargetsConfig()
+	for _, connectTo := range []string{"127.0.0.1:5900", "/run/kvmd/old.sock"} {
+		if isTunnelTargetAllowed(cfg, parseTunnelTarget(connectTo)) {
+			t.Errorf("%s: raw target of a disabled service is allowed", connectTo)
+		}
+	}
+
+	cfg.Services["vnc"] = config.ServiceConfig{Enabled: true, Target: "127.0.0.1:5900"}
+	if !isTunnelTargetAllowed(cfg, parseTunnelTarget("127.0.0.1:5900")) {
+		t.Error("raw target of an enabled service is rejected")
+	}
+}
+
+func TestResolveTunnelTargetErrorCodes(t *testing.T) {
+	cfg := testTargetsConfig()
+	cases := []struct {
+		connectTo string
+		want      TunnelErrorCode
+	}{
+		{"web", ""},
+		{"vnc", TunnelErrorServiceDisabled},
+		{"nope", TunnelErrorUnknownService},
+		{"/run/kvmd/other.sock", ""},
+	}
+	for _, c := range cases {
+		header := &proxyagent_pb.ConnectionMessage_Header{Cid: "cid", ConnectTo: c.connectTo}
+		if tunnelErr := validateTunnelHeader(header); tunnelErr != nil {
+			t.Errorf("%s: valid header rejected: %v", c.connectTo, tunnelErr)
+			continue
+		}
+		var got TunnelErrorCode
+		if _, tunnelErr := resolveTunnelTarget(cfg, c.connectTo); tunnelErr != nil {
+			got = tunnelErr.Code
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.connectTo, got, c.want)
+		}
+	}
+
+	header := &proxyagent_pb.ConnectionMessage_Header{Cid: "cid", ConnectTo: "host:port:extra"}
+	if tunnelErr := validateTunnelHeader(header); tunnelErr == nil || tunnelErr.Code != TunnelErrorMalformedHeader {
+		t.Errorf("got %v for an invalid host:port, want %s", tunnelErr, TunnelErrorMalformedHeader)
+	}
+}